@@ -7,26 +7,112 @@ package cmd
 import (
 	"context"
 	"dsa/cmd/gossip"
+	"encoding/base64"
+	"fmt"
 	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var gossipAddr string
 var gossipSeed []string
+var gossipMode string
+var gossipTransport string
+var gossipKeys []string
+var gossipCodec string
+var gossipCompress bool
+var gossipTLSCert string
+var gossipTLSKey string
+var gossipTLSCA string
+var gossipLogLevel string
+var gossipLogFormat string
+var gossipSeedFile string
+var gossipSeedDNS string
+var gossipSeedDNSService string
+var gossipSeedDNSPort int
+var gossipDNSServer string
+var gossipTags map[string]string
+var gossipConfig = gossip.DefaultConfig()
 
 // gossipCmd represents the gossip command
 var gossipCmd = &cobra.Command{
 	Use:   "gossip",
 	Short: "Simple implementation of gossip protocol",
-	Run: func(cmd *cobra.Command, args []string) {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		srv := gossip.NewServer(gossipSeed)
-		go func() {
-			if err := srv.Start(ctx, gossipAddr); err != nil {
-				println(err.Error())
+	RunE: func(cmd *cobra.Command, args []string) error {
+		level, err := gossip.ParseLevel(gossipLogLevel)
+		if err != nil {
+			return err
+		}
+		logger, err := gossip.NewLogger(os.Stderr, level, gossipLogFormat)
+		if err != nil {
+			return err
+		}
+		gossipConfig.Logger = logger
+		mode, err := gossip.ParseMode(gossipMode)
+		if err != nil {
+			return err
+		}
+		gossipConfig.Mode = mode
+		transport, err := gossip.NewTransport(gossipTransport)
+		if err != nil {
+			return err
+		}
+		if gossipTLSCert != "" {
+			if gossipTransport != "http" {
+				return fmt.Errorf("tls is only supported by the http transport")
+			}
+			tlsConfig, err := gossip.LoadMutualTLS(gossipTLSCert, gossipTLSKey, gossipTLSCA)
+			if err != nil {
+				return err
+			}
+			transport = gossip.NewTLSTransport(tlsConfig)
+		}
+		if t, ok := transport.(*gossip.HTTPTransport); ok {
+			codec, err := gossip.ParseCodec(gossipCodec)
+			if err != nil {
+				return err
+			}
+			t.Codec = codec
+			t.Compress = gossipCompress
+		}
+		gossipConfig.Transport = transport
+		if len(gossipTags) > 0 {
+			gossipConfig.Tags = gossipTags
+		}
+		if gossipSeedFile != "" {
+			gossipConfig.SeedProviders = append(gossipConfig.SeedProviders, gossip.FileSeeds{Path: gossipSeedFile})
+		}
+		if gossipSeedDNS != "" {
+			seeds := gossip.DNSSeeds{Name: gossipSeedDNS, Service: gossipSeedDNSService, Port: gossipSeedDNSPort}
+			if gossipTransport == "udp" {
+				seeds.Proto = "udp"
 			}
-		}()
-		<-ctx.Done()
+			if gossipDNSServer != "" {
+				seeds.Resolver = gossip.NewDNSResolver(gossipDNSServer)
+			}
+			gossipConfig.SeedProviders = append(gossipConfig.SeedProviders, seeds)
+		}
+		if len(gossipKeys) > 0 {
+			var keys [][]byte
+			for _, k := range gossipKeys {
+				key, err := base64.StdEncoding.DecodeString(k)
+				if err != nil {
+					return fmt.Errorf("invalid key: %w", err)
+				}
+				keys = append(keys, key)
+			}
+			keyring, err := gossip.NewKeyring(keys...)
+			if err != nil {
+				return err
+			}
+			gossipConfig.Keyring = keyring
+		}
+		// the node leaves the cluster and flushes its state when interrupted
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		srv := gossip.NewServer(gossipSeed, gossipConfig)
+		return srv.Start(ctx, gossipAddr)
 	},
 }
 
@@ -34,4 +120,41 @@ func init() {
 	rootCmd.AddCommand(gossipCmd)
 	gossipCmd.Flags().StringVar(&gossipAddr, "addr", ":8080", "gossip address")
 	gossipCmd.Flags().StringSliceVar(&gossipSeed, "seed", []string{}, "gossip seed")
+	gossipCmd.Flags().StringToStringVar(&gossipTags, "tag", map[string]string{}, "tags of the node, such as role=db,zone=a")
+	gossipCmd.Flags().BoolVar(&gossipConfig.Election, "election", false, "elect a leader among the live members")
+	gossipCmd.Flags().IntVar(&gossipConfig.Quorum, "quorum", 0, "number of live members needed to elect a leader, a majority of the members if 0")
+	gossipCmd.Flags().DurationVar(&gossipConfig.DeadTimeout, "dead-timeout", gossipConfig.DeadTimeout, "time a dead member still counts in the quorum")
+	gossipCmd.Flags().StringVar(&gossipSeedFile, "seed-file", "", "file listing the gossip seeds, one per line")
+	gossipCmd.Flags().StringVar(&gossipSeedDNS, "seed-dns", "", "dns name resolving to the gossip seeds")
+	gossipCmd.Flags().StringVar(&gossipSeedDNSService, "seed-dns-service", "", "service of the srv records of the seeds, instead of a and aaaa records")
+	gossipCmd.Flags().IntVar(&gossipSeedDNSPort, "seed-dns-port", 8080, "port of the seeds resolved from a and aaaa records")
+	gossipCmd.Flags().StringVar(&gossipDNSServer, "dns-server", "", "address of the dns server resolving the seeds, instead of the system resolver")
+	gossipCmd.Flags().DurationVar(&gossipConfig.SeedInterval, "seed-interval", gossipConfig.SeedInterval, "time between two polls of the seeds")
+	gossipCmd.Flags().DurationVar(&gossipConfig.Interval, "interval", gossipConfig.Interval, "time between two gossip rounds")
+	gossipCmd.Flags().IntVar(&gossipConfig.Fanout, "fanout", gossipConfig.Fanout, "number of nodes to gossip with every round")
+	gossipCmd.Flags().DurationVar(&gossipConfig.Timeout, "timeout", gossipConfig.Timeout, "timeout of the gossip requests")
+	gossipCmd.Flags().StringVar(&gossipMode, "mode", string(gossipConfig.Mode), "gossip mode (push, pull or push-pull)")
+	gossipCmd.Flags().DurationVar(&gossipConfig.ProbeInterval, "probe-interval", gossipConfig.ProbeInterval, "time between two failure detection probes")
+	gossipCmd.Flags().DurationVar(&gossipConfig.ProbeTimeout, "probe-timeout", gossipConfig.ProbeTimeout, "time to wait for a probe ack")
+	gossipCmd.Flags().IntVar(&gossipConfig.IndirectChecks, "indirect-checks", gossipConfig.IndirectChecks, "number of nodes asked to probe an unresponsive node")
+	gossipCmd.Flags().DurationVar(&gossipConfig.SuspicionTimeout, "suspicion-timeout", gossipConfig.SuspicionTimeout, "time a suspected node has to refute the suspicion")
+	gossipCmd.Flags().StringVar(&gossipTransport, "transport", "http", "gossip transport (http, tcp or udp)")
+	gossipCmd.Flags().StringVar(&gossipConfig.APIAddr, "api-addr", "", "address of the http api, for the tcp and udp transports")
+	gossipCmd.Flags().StringVar(&gossipCodec, "codec", "binary", "encoding of the gossip messages over http (json or binary)")
+	gossipCmd.Flags().BoolVar(&gossipCompress, "compress", true, "compress the large gossip messages over http")
+	gossipCmd.Flags().StringSliceVar(&gossipKeys, "key", []string{}, "base64 encoded keys encrypting the gossip messages, the primary first")
+	gossipCmd.Flags().StringVar(&gossipTLSCert, "tls-cert", "", "certificate of the node, for mutual tls")
+	gossipCmd.Flags().StringVar(&gossipTLSKey, "tls-key", "", "private key of the node, for mutual tls")
+	gossipCmd.Flags().StringVar(&gossipTLSCA, "tls-ca", "", "certificate authority of the cluster, for mutual tls")
+	gossipCmd.Flags().StringVar(&gossipConfig.DataDir, "data-dir", "", "directory where the state is persisted across restarts")
+	gossipCmd.Flags().DurationVar(&gossipConfig.SnapshotInterval, "snapshot-interval", gossipConfig.SnapshotInterval, "time between two snapshots of the state")
+	gossipCmd.Flags().IntVar(&gossipConfig.MaxMessageSize, "max-message-size", gossipConfig.MaxMessageSize, "maximum size in bytes of the received messages and api requests")
+	gossipCmd.Flags().Float64Var(&gossipConfig.RateLimit, "rate-limit", gossipConfig.RateLimit, "number of messages per second accepted from each address")
+	gossipCmd.Flags().IntVar(&gossipConfig.RateBurst, "rate-burst", gossipConfig.RateBurst, "number of messages a node can send at once above its rate limit")
+	gossipCmd.Flags().IntVar(&gossipConfig.MaxKeys, "max-keys", gossipConfig.MaxKeys, "maximum number of keys of each node")
+	gossipCmd.Flags().IntVar(&gossipConfig.MaxValueLength, "max-value-length", gossipConfig.MaxValueLength, "maximum length in bytes of a value")
+	gossipCmd.Flags().StringVar(&gossipLogLevel, "log-level", "info", "minimum level of the logs (debug, info, warn or error)")
+	gossipCmd.Flags().StringVar(&gossipLogFormat, "log-format", "text", "format of the logs (text or json)")
+	gossipCmd.Flags().DurationVar(&gossipConfig.TombstoneGrace, "tombstone-grace", gossipConfig.TombstoneGrace, "time a deleted key is remembered")
+	gossipCmd.Flags().DurationVar(&gossipConfig.MaxClockOffset, "max-clock-offset", gossipConfig.MaxClockOffset, "how far ahead of the local clock the received versions can be")
 }
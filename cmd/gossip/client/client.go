@@ -0,0 +1,409 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package client is a client of the HTTP API of the gossip nodes.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a key does not exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// StatusError is returned when a node responds with an unexpected status.
+type StatusError struct {
+	// StatusCode is the http status of the response.
+	StatusCode int
+	// Message is the body of the response.
+	Message string
+}
+
+// Error returns the error message
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Message)
+}
+
+// temporary returns true if the request can be retried
+func (e *StatusError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Version is the version of a value.
+type Version struct {
+	// Time is the physical part of the version, in unix milliseconds.
+	Time int64 `json:"time"`
+	// Counter is the logical part of the version.
+	Counter int `json:"counter"`
+	// Node is the id of the node that wrote the value.
+	Node string `json:"node"`
+}
+
+// Value is the value of a key.
+type Value struct {
+	// Version is the version of the value.
+	Version Version `json:"version"`
+	// Value is the string value.
+	Value string `json:"value"`
+	// Deleted is true if the key was deleted.
+	Deleted bool `json:"deleted,omitempty"`
+	// Type is the type of the CRDT, if the value is a CRDT.
+	Type string `json:"type,omitempty"`
+	// CRDT is the JSON encoding of the CRDT, if the value is a CRDT.
+	CRDT json.RawMessage `json:"crdt,omitempty"`
+	// Expires is the time the value expires at, in unix milliseconds,
+	// or 0 if it does not expire.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Member is a node of the cluster.
+type Member struct {
+	// ID is the id of the node.
+	ID string `json:"id"`
+	// Address is the gossip address of the node.
+	Address string `json:"address"`
+	// Status is the liveness status of the node.
+	Status string `json:"status"`
+	// Incarnation is the incarnation number of the node.
+	Incarnation int `json:"incarnation"`
+	// Tags are the tags of the node.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// State is the state of the cluster, as seen by a node.
+type State struct {
+	// Metadata are the values of each node.
+	Metadata map[string]map[string]Value `json:"metadata"`
+	// Members are the known nodes of the cluster.
+	Members []Member `json:"members"`
+}
+
+// Leadership is the leader of the cluster, as seen by a node.
+type Leadership struct {
+	// Leader is the id of the leader, or "" if there is none.
+	Leader string `json:"leader"`
+	// Incarnation is the incarnation of the leader, as seen by the node.
+	Incarnation int `json:"incarnation"`
+	// Quorum is true if the node sees a quorum of the members.
+	Quorum bool `json:"quorum"`
+	// Conflicts are the alive members that see another leader.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// Event is a change of a key.
+type Event struct {
+	// Node is the id of the node that wrote the key.
+	Node string `json:"node"`
+	// Key is the changed key.
+	Key string `json:"key"`
+	// OldVersion is the version of the key before the change.
+	OldVersion Version `json:"old_version"`
+	// NewVersion is the version of the key after the change.
+	NewVersion Version `json:"new_version"`
+	// Value is the value of the key after the change.
+	Value *Value `json:"value"`
+}
+
+// Config is the configuration of a Client.
+// Zero values are replaced by the defaults.
+type Config struct {
+	// HTTPClient is the http client used to send the requests.
+	HTTPClient *http.Client
+	// TLSConfig is the TLS configuration of the nodes that serve their
+	// API over TLS. The requests are sent in clear if it is nil.
+	TLSConfig *tls.Config
+	// Retries is the number of times a failed request is retried.
+	// A negative value disables the retries.
+	Retries int
+	// Backoff is the time to wait before the first retry.
+	// It doubles with every retry.
+	Backoff time.Duration
+	// MaxEventSize is the maximum size of an event received by Watch. It
+	// must be at least the maximum message size of the node, which bounds
+	// the size of the values.
+	MaxEventSize int
+}
+
+// DefaultConfig returns the default configuration
+func DefaultConfig() Config {
+	return Config{
+		HTTPClient: http.DefaultClient,
+		Retries:    3,
+		Backoff:    100 * time.Millisecond,
+		// the default maximum message size of the nodes
+		MaxEventSize: 4 << 20,
+	}
+}
+
+// withDefaults returns the configuration with the zero values replaced by the defaults
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.HTTPClient == nil && c.TLSConfig != nil {
+		c.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: c.TLSConfig},
+		}
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = d.HTTPClient
+	}
+	if c.Retries == 0 {
+		c.Retries = d.Retries
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = d.Backoff
+	}
+	if c.MaxEventSize <= 0 {
+		c.MaxEventSize = d.MaxEventSize
+	}
+	return c
+}
+
+// Client is a client of the HTTP API of a gossip node.
+type Client struct {
+	// addr is the address of the node.
+	addr   string
+	config Config
+}
+
+// New creates a client of the node at the given address (host:port)
+func New(addr string, config Config) *Client {
+	return &Client{
+		addr:   addr,
+		config: config.withDefaults(),
+	}
+}
+
+// Set writes key value pairs on the node
+func (c *Client) Set(ctx context.Context, values map[string]string) error {
+	return c.do(ctx, http.MethodPost, "/", nil, values, nil)
+}
+
+// SetTTL writes key value pairs on the node, that expire after the given
+// ttl on every node unless they are written again
+func (c *Client) SetTTL(ctx context.Context, values map[string]string, ttl time.Duration) error {
+	return c.do(ctx, http.MethodPost, "/", url.Values{"ttl": {ttl.String()}}, values, nil)
+}
+
+// Delete deletes keys of the node
+func (c *Client) Delete(ctx context.Context, keys ...string) error {
+	return c.do(ctx, http.MethodDelete, "/", nil, keys, nil)
+}
+
+// State returns the state of the cluster, as seen by the node
+func (c *Client) State(ctx context.Context) (*State, error) {
+	var state State
+	if err := c.do(ctx, http.MethodGet, "/state", url.Values{"members": {"true"}}, nil, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Get returns the value of a key written by the given node.
+// It returns ErrNotFound if the key does not exist or was deleted.
+func (c *Client) Get(ctx context.Context, node string, key string) (Value, error) {
+	var metadata map[string]map[string]Value
+	if err := c.do(ctx, http.MethodGet, "/state", nil, nil, &metadata); err != nil {
+		return Value{}, err
+	}
+	value, ok := metadata[node][key]
+	if !ok || value.Deleted {
+		return Value{}, fmt.Errorf("%w: %s on %s", ErrNotFound, key, node)
+	}
+	return value, nil
+}
+
+// Members returns the live members of the cluster whose tags match the
+// selector, as seen by the node. A selector is a comma separated list of
+// key=value, key!=value, key or !key requirements, such as "role=db,zone!=a".
+// The empty selector returns all the live members.
+func (c *Client) Members(ctx context.Context, selector string) ([]Member, error) {
+	var query url.Values
+	if selector != "" {
+		query = url.Values{"selector": {selector}}
+	}
+	var members []Member
+	if err := c.do(ctx, http.MethodGet, "/members", query, nil, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Leader returns the leader of the cluster, as seen by the node
+func (c *Client) Leader(ctx context.Context) (Leadership, error) {
+	var leadership Leadership
+	if err := c.do(ctx, http.MethodGet, "/leader", nil, nil, &leadership); err != nil {
+		return Leadership{}, err
+	}
+	return leadership, nil
+}
+
+// Watch streams the changes of the keys starting with the given prefix.
+// The events channel is closed when the context is canceled or the stream
+// ends. If the stream failed, such as on an event larger than MaxEventSize,
+// its error is sent on the errors channel first. The errors channel is
+// closed with the events channel.
+func (c *Client) Watch(ctx context.Context, prefix string) (<-chan Event, <-chan error, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/watch", url.Values{"prefix": {prefix}}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, nil, statusError(resp)
+	}
+
+	events := make(chan Event)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(events)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		// an event line holds a value escaped in JSON, and its envelope
+		scanner.Buffer(make([]byte, 0, 64<<10), c.config.MaxEventSize)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				errs <- fmt.Errorf("invalid event: %w", err)
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			errs <- err
+		}
+	}()
+	return events, errs, nil
+}
+
+// do sends a request to the node, retrying the temporary failures,
+// and decodes the response into out if it is not nil
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	backoff := c.config.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.try(ctx, method, path, query, body, out)
+		var statusErr *StatusError
+		if err == nil || attempt == c.config.Retries || ctx.Err() != nil ||
+			(errors.As(err, &statusErr) && !statusErr.temporary()) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// try sends a request to the node once
+func (c *Client) try(ctx context.Context, method string, path string, query url.Values, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := c.newRequest(ctx, method, path, query, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// newRequest creates a request to the node
+func (c *Client) newRequest(ctx context.Context, method string, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	scheme := "http"
+	if c.config.TLSConfig != nil {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     c.addr,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// statusError returns the error of a response with an unexpected status
+func statusError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+}
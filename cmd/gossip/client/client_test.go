@@ -0,0 +1,128 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package client
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientRetries(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		if attempts < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		// the values alone, without the members
+		assert.Empty(t, r.URL.Query().Get("members"))
+		w.Write([]byte(`{"a":{"k":{"version":{"time":1,"counter":0,"node":"a"},"value":"v"}}}`))
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"), Config{Backoff: time.Millisecond})
+	value, err := c.Get(context.Background(), "a", "k")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Version: Version{Time: 1, Node: "a"}, Value: "v"}, value)
+	assert.Equal(t, 3, attempts)
+
+	_, err = c.Get(context.Background(), "a", "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestClientMembers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/members", r.URL.Path)
+		assert.Equal(t, "role=db", r.URL.Query().Get("selector"))
+		w.Write([]byte(`[{"id":"a","address":"a","status":"alive","incarnation":0,"tags":{"role":"db"}}]`))
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"), Config{Backoff: time.Millisecond})
+	members, err := c.Members(context.Background(), "role=db")
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{{ID: "a", Address: "a", Status: "alive", Tags: map[string]string{"role": "db"}}}, members)
+}
+
+func TestClientLeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/leader", r.URL.Path)
+		w.Write([]byte(`{"leader":"a","incarnation":2,"quorum":true}`))
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"), Config{Backoff: time.Millisecond})
+	leadership, err := c.Leader(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, Leadership{Leader: "a", Incarnation: 2, Quorum: true}, leadership)
+}
+
+func TestClientStatusError(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "invalid", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"), Config{Backoff: time.Millisecond})
+	err := c.Set(context.Background(), map[string]string{"a": "b"})
+	var statusErr *StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+	assert.Equal(t, "invalid", statusErr.Message)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestClientContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c := New(strings.TrimPrefix(srv.URL, "http://"), Config{Retries: 100, Backoff: 10 * time.Millisecond})
+	_, err := c.State(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClientSetTTL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "30s", r.URL.Query().Get("ttl"))
+	}))
+	defer srv.Close()
+
+	c := New(strings.TrimPrefix(srv.URL, "http://"), Config{})
+	assert.NoError(t, c.SetTTL(context.Background(), map[string]string{"a": "n"}, 30*time.Second))
+}
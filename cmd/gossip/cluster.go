@@ -0,0 +1,248 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Cluster is a local cluster of gossip servers running in the same
+// process, on consecutive ports. Every node is seeded with the others,
+// or with the first one if the ports are random.
+type Cluster struct {
+	// addrs are the addresses of the nodes.
+	addrs []string
+	// randomPorts is true if the nodes listen on random ports.
+	randomPorts bool
+	// servers are the servers of the nodes, in the order of their addresses.
+	servers []*Server
+	// start is the time the cluster was created.
+	start time.Time
+	// convergedAt is the time the cluster first converged, if it did.
+	convergedAt time.Time
+}
+
+// NewCluster creates a cluster of the given number of nodes, listening on the
+// given host from the base port onwards. If the base port is 0, the nodes
+// listen on random ports, and are seeded with the first node once it listens.
+// The transport of the configuration is ignored, every node gets its own
+// http transport.
+func NewCluster(nodes int, host string, basePort int, config Config) *Cluster {
+	c := &Cluster{start: time.Now(), randomPorts: basePort == 0}
+	for i := 0; i < nodes; i++ {
+		port := 0
+		if !c.randomPorts {
+			port = basePort + i
+		}
+		c.addrs = append(c.addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	for i := range c.addrs {
+		nodeConfig := config
+		nodeConfig.Transport = NewHTTPTransport()
+		var seeds []string
+		if c.randomPorts {
+			if i > 0 {
+				nodeConfig.SeedProviders = append(append([]SeedProvider(nil), config.SeedProviders...), firstNodeSeeds{c})
+			}
+		} else {
+			for j, addr := range c.addrs {
+				if j != i {
+					seeds = append(seeds, addr)
+				}
+			}
+		}
+		c.servers = append(c.servers, NewServer(seeds, nodeConfig))
+	}
+	return c
+}
+
+// Servers returns the servers of the nodes
+func (c *Cluster) Servers() []*Server {
+	return c.servers
+}
+
+// Start starts every node, and stops them when the context is done. If a
+// node fails to start, the others are stopped and the error is returned.
+func (c *Cluster) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(c.servers))
+	for i, s := range c.servers {
+		go func(s *Server, addr string) {
+			errs <- s.Start(ctx, addr)
+		}(s, c.addrs[i])
+		if i == 0 && c.randomPorts {
+			// the other nodes are seeded with the first one once it listens
+			for !listening(s) {
+				select {
+				case err := <-errs:
+					return err
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}
+	}
+	var result error
+	for range c.servers {
+		if err := <-errs; err != nil && result == nil {
+			result = err
+			cancel()
+		}
+	}
+	return result
+}
+
+// Converged returns true if every node sees all the nodes as alive, and
+// has the same metadata, ignoring the heartbeats that change every round
+func (c *Cluster) Converged() bool {
+	var metadata []ClusterMetadata
+	for _, s := range c.servers {
+		s.lock.RLock()
+		alive := 0
+		for _, member := range s.members() {
+			if member.Status == StatusAlive {
+				alive++
+			}
+		}
+		started := s.id != ""
+		metadata = append(metadata, deltaSince(s.metadata, Digest{}))
+		s.lock.RUnlock()
+		if !started || alive != len(c.servers) {
+			return false
+		}
+	}
+	return sameMetadata(metadata)
+}
+
+// WriteTable writes a table of the members seen by every node, followed
+// by the convergence status of the cluster. It must not be called concurrently.
+func (c *Cluster) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tALIVE\tSUSPECT\tDEAD\tLEFT\tKEYS\tINCARNATION")
+	for i, s := range c.servers {
+		s.lock.RLock()
+		statuses := make(map[NodeStatus]int)
+		for _, member := range s.members() {
+			statuses[member.Status]++
+		}
+		keys := 0
+		for _, state := range s.metadata {
+			keys += len(state)
+		}
+		incarnation := s.incarnation
+		addr := c.addrs[i]
+		if c.randomPorts && s.id != "" {
+			addr = s.id
+		}
+		s.lock.RUnlock()
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", addr,
+			statuses[StatusAlive], statuses[StatusSuspect], statuses[StatusDead], statuses[StatusLeft],
+			keys, incarnation)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if !c.Converged() {
+		c.convergedAt = time.Time{}
+		_, err := fmt.Fprintf(w, "\nnot converged, %s elapsed\n", now.Sub(c.start).Round(time.Millisecond))
+		return err
+	}
+	if c.convergedAt.IsZero() {
+		c.convergedAt = now
+	}
+	_, err := fmt.Fprintf(w, "\nconverged after %s\n", c.convergedAt.Sub(c.start).Round(time.Millisecond))
+	return err
+}
+
+// Watch writes the table of the cluster every refresh interval, clearing
+// the terminal in between, until the context is done
+func (c *Cluster) Watch(ctx context.Context, w io.Writer, refresh time.Duration) error {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// move the cursor home and clear the screen
+			if _, err := io.WriteString(w, "\033[H\033[2J"); err != nil {
+				return err
+			}
+			if err := c.WriteTable(w); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sameMetadata returns true if the given metadata are equal,
+// ignoring the heartbeats that change every round
+func sameMetadata(metadata []ClusterMetadata) bool {
+	if len(metadata) == 0 {
+		return true
+	}
+	for _, m := range metadata {
+		for _, state := range m {
+			delete(state, keyHeartbeat)
+		}
+	}
+	for _, m := range metadata[1:] {
+		if !reflect.DeepEqual(metadata[0], m) {
+			return false
+		}
+	}
+	return true
+}
+
+// listening returns true once the server listens
+func listening(s *Server) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.id != ""
+}
+
+// firstNodeSeeds provides the address of the first node of a cluster, once it listens
+type firstNodeSeeds struct {
+	cluster *Cluster
+}
+
+// Seeds returns the address of the first node, or nothing if it does not listen yet
+func (p firstNodeSeeds) Seeds(ctx context.Context) ([]string, error) {
+	s := p.cluster.servers[0]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.id == "" {
+		return nil, nil
+	}
+	return []string{s.id}, nil
+}
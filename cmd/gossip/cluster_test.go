@@ -0,0 +1,77 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCluster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewCluster(3, "127.0.0.1", 0, Config{
+		Interval:      100 * time.Millisecond,
+		ProbeInterval: 100 * time.Millisecond,
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Start(ctx)
+	}()
+
+	assert.Eventually(t, c.Converged, 10*time.Second, 100*time.Millisecond)
+
+	var buf bytes.Buffer
+	assert.NoError(t, c.WriteTable(&buf))
+	assert.Contains(t, buf.String(), "NODE")
+	assert.Contains(t, buf.String(), c.Servers()[2].Address())
+	assert.Contains(t, buf.String(), "converged after")
+
+	cancel()
+	assert.NoError(t, <-errs)
+}
+
+func TestClusterPortInUse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	addr := startServer(t, ctx, NewServer(nil, DefaultConfig()), errs)
+	_, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+	basePort, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+
+	c := NewCluster(2, "127.0.0.1", basePort, DefaultConfig())
+	assert.Error(t, c.Start(context.Background()))
+
+	cancel()
+	assert.NoError(t, <-errs)
+}
@@ -0,0 +1,364 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// binaryFormatVersion is the version of the binary encoding. Version 2
+	// added the expiry of the values, the older versions are still decoded.
+	binaryFormatVersion = 2
+	// binaryFlagDeleted flags the tombstones in the binary encoding.
+	binaryFlagDeleted = 1 << 0
+	// binaryFlagCRDT flags the CRDT values in the binary encoding.
+	binaryFlagCRDT = 1 << 1
+	// binaryFlagExpires flags the values with an expiry in the binary encoding.
+	binaryFlagExpires = 1 << 2
+)
+
+// errTruncated is returned when a binary message ends too early
+var errTruncated = errors.New("truncated message")
+
+// errUnsupportedFormat is returned when a binary message was encoded
+// with a format version newer than the ones the node understands
+var errUnsupportedFormat = errors.New("unsupported format version")
+
+// Codec encodes the messages on the wire.
+type Codec interface {
+	// ContentType returns the content type of the encoded messages.
+	ContentType() string
+	// Encode encodes the message.
+	Encode(msg *Message) ([]byte, error)
+	// Decode decodes a message.
+	Decode(data []byte, msg *Message) error
+}
+
+var (
+	// JSONCodec encodes the messages in JSON.
+	JSONCodec Codec = jsonCodec{}
+	// BinaryCodec encodes the messages in a compact binary format.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// codecs are the known codecs, by content type
+var codecs = map[string]Codec{
+	JSONCodec.ContentType():   JSONCodec,
+	BinaryCodec.ContentType(): BinaryCodec,
+}
+
+// ParseCodec returns the codec of the given name, json or binary
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return JSONCodec, nil
+	case "binary":
+		return BinaryCodec, nil
+	default:
+		return nil, fmt.Errorf("invalid codec %q", name)
+	}
+}
+
+// jsonCodec encodes the messages in JSON
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Encode(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Decode(data []byte, msg *Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+// binaryCodec encodes the messages in a compact binary format. Strings are
+// prefixed by their varint length, numbers are varints, and maps and slices
+// are prefixed by their number of elements. The CRDT values keep their JSON
+// encoding, prefixed by its length.
+type binaryCodec struct{}
+
+func (binaryCodec) ContentType() string {
+	return "application/x-gossip"
+}
+
+func (binaryCodec) Encode(msg *Message) ([]byte, error) {
+	w := &binaryWriter{}
+	w.buf.WriteByte(binaryFormatVersion)
+	w.string(string(msg.Type))
+	w.string(msg.From)
+	w.string(string(msg.Mode))
+	w.string(msg.Target)
+	w.bytes(msg.Sealed)
+
+	w.uvarint(uint64(len(msg.Metadata)))
+	for nodeId, state := range msg.Metadata {
+		w.string(nodeId)
+		w.uvarint(uint64(len(state)))
+		for key, v := range state {
+			w.string(key)
+			if err := w.versionedStr(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	w.uvarint(uint64(len(msg.Digest)))
+	for nodeId, version := range msg.Digest {
+		w.string(nodeId)
+		w.version(version)
+	}
+
+	w.uvarint(uint64(len(msg.Members)))
+	for _, member := range msg.Members {
+		w.string(member.ID)
+		w.string(member.Address)
+		w.string(string(member.Status))
+		w.varint(int64(member.Incarnation))
+	}
+	return w.buf.Bytes(), nil
+}
+
+func (binaryCodec) Decode(data []byte, msg *Message) error {
+	r := &binaryReader{data: data}
+	if version := r.byte(); r.err == nil && (version == 0 || version > binaryFormatVersion) {
+		return fmt.Errorf("%w %d", errUnsupportedFormat, version)
+	}
+	*msg = Message{}
+	msg.Type = MessageType(r.string())
+	msg.From = r.string()
+	msg.Mode = Mode(r.string())
+	msg.Target = r.string()
+	msg.Sealed = r.bytes()
+
+	if n := r.length(); n > 0 {
+		msg.Metadata = make(ClusterMetadata, n)
+		for i := 0; i < n; i++ {
+			nodeId := r.string()
+			keys := r.length()
+			state := make(NodeState, keys)
+			for j := 0; j < keys; j++ {
+				key := r.string()
+				state[key] = r.versionedStr()
+			}
+			msg.Metadata[nodeId] = state
+		}
+	}
+
+	if n := r.length(); n > 0 {
+		msg.Digest = make(Digest, n)
+		for i := 0; i < n; i++ {
+			nodeId := r.string()
+			msg.Digest[nodeId] = r.version()
+		}
+	}
+
+	if n := r.length(); n > 0 {
+		msg.Members = make([]Member, n)
+		for i := range msg.Members {
+			msg.Members[i] = Member{
+				ID:          r.string(),
+				Address:     r.string(),
+				Status:      NodeStatus(r.string()),
+				Incarnation: int(r.varint()),
+			}
+		}
+	}
+	if r.err == nil && len(r.data) > 0 {
+		return fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	return r.err
+}
+
+// binaryWriter writes the binary encoding of a message
+type binaryWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *binaryWriter) uvarint(x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+func (w *binaryWriter) varint(x int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutVarint(b[:], x)])
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *binaryWriter) version(v Version) {
+	w.varint(v.Time)
+	w.varint(int64(v.Counter))
+	w.string(v.Node)
+}
+
+func (w *binaryWriter) versionedStr(v *VersionedStr) error {
+	w.version(v.Version)
+	w.string(v.Value)
+	var flags byte
+	if v.Deleted {
+		flags |= binaryFlagDeleted
+	}
+	if v.CRDT != nil {
+		flags |= binaryFlagCRDT
+	}
+	if v.Expires != 0 {
+		flags |= binaryFlagExpires
+	}
+	w.buf.WriteByte(flags)
+	if v.Expires != 0 {
+		w.varint(v.Expires)
+	}
+	if v.CRDT != nil {
+		data, err := json.Marshal(v.CRDT)
+		if err != nil {
+			return err
+		}
+		w.string(string(v.CRDT.Type()))
+		w.bytes(data)
+	}
+	return nil
+}
+
+// binaryReader reads the binary encoding of a message. The first error
+// is kept, and the following reads return zero values.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *binaryReader) byte() byte {
+	if len(r.data) == 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+func (r *binaryReader) varint() int64 {
+	x, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+// length reads the length of a map, a slice or a string. It cannot
+// exceed the remaining bytes, so that a forged length cannot make
+// the reader allocate more memory than the message.
+func (r *binaryReader) length() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail(errTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.data)
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) version() Version {
+	return Version{
+		Time:    r.varint(),
+		Counter: int(r.varint()),
+		Node:    r.string(),
+	}
+}
+
+func (r *binaryReader) versionedStr() *VersionedStr {
+	v := &VersionedStr{
+		Version: r.version(),
+		Value:   r.string(),
+	}
+	flags := r.byte()
+	v.Deleted = flags&binaryFlagDeleted != 0
+	if flags&binaryFlagExpires != 0 {
+		v.Expires = r.varint()
+	}
+	if flags&binaryFlagCRDT != 0 {
+		t := CRDTType(r.string())
+		data := r.bytes()
+		if r.err != nil {
+			return v
+		}
+		crdt, err := decodeCRDT(t, data)
+		if err != nil {
+			r.fail(err)
+			return v
+		}
+		v.CRDT = crdt
+	}
+	return v
+}
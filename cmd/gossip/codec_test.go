@@ -0,0 +1,232 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestMessage returns a message with every kind of field
+func newTestMessage() *Message {
+	return &Message{
+		Type: MessageSyn,
+		From: "a",
+		Metadata: ClusterMetadata{
+			"a": {
+				"a": {Version: Version{Time: 1, Counter: 2, Node: "a"}, Value: "a"},
+				"b": {Version: Version{Time: -1, Node: "a"}, Deleted: true},
+				"c": {Version: Version{Time: 3, Node: "a"}, CRDT: GCounter{"a": 3}},
+				"d": {Version: Version{Time: 4, Node: "a"}, Value: "d", Expires: 5},
+			},
+			"b": {},
+		},
+		Digest:  Digest{"a": {Time: 1, Node: "a"}, "b": {}},
+		Members: []Member{{ID: "a", Address: "a", Status: StatusSuspect, Incarnation: 3}},
+		Mode:    ModePull,
+		Target:  "b",
+		Sealed:  []byte{0, 1, 2},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, BinaryCodec} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			for _, msg := range []*Message{newTestMessage(), {Type: MessagePing}} {
+				data, err := codec.Encode(msg)
+				assert.NoError(t, err)
+				var decoded Message
+				assert.NoError(t, codec.Decode(data, &decoded))
+				assert.Equal(t, msg, &decoded)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecVersion1(t *testing.T) {
+	msg := &Message{Type: MessagePing, From: "a"}
+	data, err := BinaryCodec.Encode(msg)
+	assert.NoError(t, err)
+	data[0] = 1
+	var decoded Message
+	assert.NoError(t, BinaryCodec.Decode(data, &decoded))
+	assert.Equal(t, msg, &decoded)
+
+	data[0] = binaryFormatVersion + 1
+	assert.ErrorIs(t, BinaryCodec.Decode(data, &decoded), errUnsupportedFormat)
+}
+
+func TestBinaryCodecSize(t *testing.T) {
+	msg := newTestMessage()
+	jsonBytes, err := JSONCodec.Encode(msg)
+	assert.NoError(t, err)
+	binaryBytes, err := BinaryCodec.Encode(msg)
+	assert.NoError(t, err)
+	assert.Less(t, len(binaryBytes), len(jsonBytes)/2)
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	data, err := BinaryCodec.Encode(newTestMessage())
+	assert.NoError(t, err)
+	for i := 0; i < len(data); i++ {
+		var msg Message
+		assert.Error(t, BinaryCodec.Decode(data[:i], &msg), "%d bytes", i)
+	}
+	var msg Message
+	assert.Error(t, BinaryCodec.Decode(append(data, 0), &msg))
+}
+
+func TestHTTPTransportCompression(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := NewHTTPTransport()
+	var encoding string
+	err := server.Listen("127.0.0.1:0", func(ctx context.Context, msg *Message) (*Message, error) {
+		return &Message{Type: MessageAck, Metadata: msg.Metadata}, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		server.ServeHTTP(w, r)
+	})
+
+	state := make(NodeState)
+	for i := 0; i < 100; i++ {
+		state[fmt.Sprint("key", i)] = &VersionedStr{Version: Version{Time: int64(i), Node: "a"}, Value: strings.Repeat("a", 100)}
+	}
+	ack, err := NewHTTPTransport().Send(ctx, server.Addr(), &Message{Type: MessageAck2, Metadata: ClusterMetadata{"a": state}})
+	assert.NoError(t, err)
+	assert.Equal(t, ClusterMetadata{"a": state}, ack.Metadata)
+	assert.Equal(t, "gzip", encoding)
+}
+
+func TestHTTPTransportFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// an older node only understands uncompressed JSON,
+	// and answers without content type
+	var requests int
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Content-Encoding") != "" {
+			http.Error(w, "invalid content type", http.StatusBadRequest)
+			return
+		}
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header()["Content-Type"] = nil
+		json.NewEncoder(w).Encode(&Message{From: "legacy", Members: msg.Members})
+	}))
+	defer legacy.Close()
+	addr := strings.TrimPrefix(legacy.URL, "http://")
+
+	transport := NewHTTPTransport()
+	members := []Member{{ID: "a", Status: StatusAlive}}
+	for i := 0; i < 2; i++ {
+		ack, err := transport.Send(ctx, addr, &Message{Type: MessagePing, From: "a", Members: members})
+		assert.NoError(t, err)
+		assert.Equal(t, &Message{From: "legacy", Members: members}, ack)
+	}
+	// the node is sent JSON directly once it is known
+	assert.Equal(t, 3, requests)
+
+	// until it may have been upgraded
+	transport.jsonOnly[addr] = time.Now().Add(-jsonRetry)
+	_, err := transport.Send(ctx, addr, &Message{Type: MessagePing, From: "a", Members: members})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, requests)
+	assert.Contains(t, transport.jsonOnly, addr)
+}
+
+func TestHTTPTransportFormatFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := NewHTTPTransport()
+	err := server.Listen("127.0.0.1:0", func(ctx context.Context, msg *Message) (*Message, error) {
+		return &Message{Type: MessageAck, From: "b", Members: msg.Members}, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	// the node only reads the format versions before the one of the sender,
+	// as if the sender was a newer node
+	var types []string
+	server.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		types = append(types, r.Header.Get("Content-Type"))
+		if mediaType(r.Header.Get("Content-Type")) == BinaryCodec.ContentType() {
+			body, _ := ioutil.ReadAll(r.Body)
+			body[0]++
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		server.ServeHTTP(w, r)
+	})
+
+	transport := NewHTTPTransport()
+	members := []Member{{ID: "a", Status: StatusAlive}}
+	ack, err := transport.Send(ctx, server.Addr(), &Message{Type: MessagePing, From: "a", Members: members})
+	assert.NoError(t, err)
+	assert.Equal(t, members, ack.Members)
+	assert.Equal(t, []string{BinaryCodec.ContentType(), JSONCodec.ContentType()}, types)
+	assert.Contains(t, transport.jsonOnly, server.Addr())
+}
+
+func TestHTTPTransportNoFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the other errors do not mean that the node only understands JSON
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "invalid message", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	transport := NewHTTPTransport()
+	_, err := transport.Send(ctx, addr, &Message{Type: MessagePing, From: "a"})
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Empty(t, transport.jsonOnly)
+}
@@ -0,0 +1,232 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"dsa/cmd/gossip/ring"
+	"fmt"
+	"time"
+)
+
+// Mode is the way the state is exchanged during a gossip round.
+type Mode string
+
+const (
+	// ModePush only sends the entries the other node is missing.
+	ModePush Mode = "push"
+	// ModePull only fetches the entries the local node is missing.
+	ModePull Mode = "pull"
+	// ModePushPull both sends and fetches the missing entries.
+	ModePushPull Mode = "push-pull"
+)
+
+// ParseMode parses a gossip mode
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case ModePush, ModePull, ModePushPull:
+		return Mode(s), nil
+	default:
+		return "", fmt.Errorf("invalid gossip mode %q", s)
+	}
+}
+
+// pushes returns true if the mode sends the entries the other node is missing
+func (m Mode) pushes() bool {
+	return m != ModePull
+}
+
+// pulls returns true if the mode fetches the entries the local node is missing
+func (m Mode) pulls() bool {
+	return m != ModePush
+}
+
+// Config is the configuration of a gossip server.
+// Zero values are replaced by the defaults.
+type Config struct {
+	// Interval is the time between two gossip rounds.
+	Interval time.Duration
+	// Fanout is the number of nodes to gossip with every round.
+	Fanout int
+	// Timeout is the timeout of the gossip requests.
+	Timeout time.Duration
+	// Mode is the way the state is exchanged during a gossip round.
+	Mode Mode
+	// ProbeInterval is the duration of a SWIM protocol period.
+	ProbeInterval time.Duration
+	// ProbeTimeout is the time to wait for the ack of a direct ping.
+	ProbeTimeout time.Duration
+	// IndirectChecks is the number of members asked to ping
+	// a member that did not answer a direct ping.
+	IndirectChecks int
+	// SuspicionTimeout is the time a member has to refute a suspicion.
+	SuspicionTimeout time.Duration
+	// TombstoneGrace is the time a deleted key is remembered. It must be
+	// long enough for the deletion to reach every node.
+	TombstoneGrace time.Duration
+	// Transport carries the messages between the nodes. It defaults
+	// to a new HTTPTransport, which also serves the HTTP API.
+	Transport Transport
+	// APIAddr is the address of the HTTP API, for the transports
+	// that do not serve it. The API is not served if it is empty.
+	APIAddr string
+	// Keyring encrypts and authenticates the messages between the nodes.
+	// The messages are sent in clear if it is nil. It does not protect the
+	// HTTP API, which anyone reaching it can use to read and write the
+	// state: use mutual TLS, or serve the API on a private interface
+	// with APIAddr.
+	Keyring *Keyring
+	// DataDir is the directory where the state is persisted, so that it
+	// is recovered after a restart. The state is not persisted if it is empty.
+	DataDir string
+	// SnapshotInterval is the time between two snapshots of the state
+	// in the data directory.
+	SnapshotInterval time.Duration
+	// Tags are the tags of the node, such as its role or its zone. They are
+	// gossiped with the state of the node, under the gossip_tag_ prefix.
+	Tags map[string]string
+	// Ring is kept updated with the live members of the cluster, if not nil.
+	// The weight of a node on the ring is given by its weight tag.
+	Ring *ring.Ring
+	// Election elects a leader among the live members, see Leadership.
+	Election bool
+	// Quorum is the number of live members needed to elect a leader. If it is
+	// 0, a majority of the members that did not leave is needed, the recently
+	// dead ones included, so that the minority side of a partition has no leader.
+	Quorum int
+	// DeadTimeout is the time a dead member still counts in the quorum.
+	// After it, the member is considered gone for good, such as when it was
+	// replaced, and the minority side of a partition elects its own leader.
+	DeadTimeout time.Duration
+	// Logger logs the events of the node. They are discarded if it is nil.
+	Logger Logger
+	// SeedProviders provide seed nodes, on top of the ones given to NewServer.
+	SeedProviders []SeedProvider
+	// SeedInterval is the time between two polls of the seed providers.
+	// After each poll, the node gossips with a seed it lost contact with.
+	SeedInterval time.Duration
+	// MaxMessageSize is the maximum size in bytes of the received messages,
+	// once decompressed, and of the bodies of the API requests.
+	MaxMessageSize int
+	// RateLimit is the number of messages per second accepted from each
+	// network address, by the http, tcp and udp transports.
+	RateLimit float64
+	// RateBurst is the number of messages a node can send at once,
+	// above its rate limit.
+	RateBurst int
+	// MaxKeys is the maximum number of keys of the state of a node,
+	// tombstones included.
+	MaxKeys int
+	// MaxValueLength is the maximum length in bytes of a value.
+	MaxValueLength int
+	// MaxClockOffset is how far ahead of the local clock the versions
+	// received from the peers can be. The clock of the node does not
+	// follow the versions beyond it, so that a peer with a wrong clock
+	// cannot push the versions of the local writes into the future.
+	MaxClockOffset time.Duration
+}
+
+// DefaultConfig returns the default configuration
+func DefaultConfig() Config {
+	return Config{
+		Interval:         time.Second,
+		Fanout:           1,
+		Timeout:          5 * time.Second,
+		Mode:             ModePushPull,
+		ProbeInterval:    time.Second,
+		ProbeTimeout:     500 * time.Millisecond,
+		IndirectChecks:   3,
+		SuspicionTimeout: 5 * time.Second,
+		TombstoneGrace:   time.Hour,
+		DeadTimeout:      5 * time.Minute,
+		SnapshotInterval: time.Minute,
+		SeedInterval:     30 * time.Second,
+		MaxMessageSize:   4 << 20,
+		RateLimit:        50,
+		RateBurst:        100,
+		MaxKeys:          10000,
+		MaxValueLength:   64 << 10,
+		MaxClockOffset:   time.Minute,
+	}
+}
+
+// withDefaults returns the configuration with the zero values replaced by the defaults
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.Fanout <= 0 {
+		c.Fanout = d.Fanout
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = d.Timeout
+	}
+	if c.Mode == "" {
+		c.Mode = d.Mode
+	}
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = d.ProbeInterval
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = d.ProbeTimeout
+	}
+	if c.IndirectChecks <= 0 {
+		c.IndirectChecks = d.IndirectChecks
+	}
+	if c.SuspicionTimeout <= 0 {
+		c.SuspicionTimeout = d.SuspicionTimeout
+	}
+	if c.TombstoneGrace <= 0 {
+		c.TombstoneGrace = d.TombstoneGrace
+	}
+	if c.DeadTimeout <= 0 {
+		c.DeadTimeout = d.DeadTimeout
+	}
+	if c.SnapshotInterval <= 0 {
+		c.SnapshotInterval = d.SnapshotInterval
+	}
+	if c.SeedInterval <= 0 {
+		c.SeedInterval = d.SeedInterval
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = d.MaxMessageSize
+	}
+	if c.RateLimit <= 0 {
+		c.RateLimit = d.RateLimit
+	}
+	if c.RateBurst <= 0 {
+		c.RateBurst = d.RateBurst
+	}
+	if c.MaxKeys <= 0 {
+		c.MaxKeys = d.MaxKeys
+	}
+	if c.MaxValueLength <= 0 {
+		c.MaxValueLength = d.MaxValueLength
+	}
+	if c.MaxClockOffset <= 0 {
+		c.MaxClockOffset = d.MaxClockOffset
+	}
+	return c
+}
@@ -0,0 +1,311 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// This file implements conflict-free replicated data types (CRDTs)
+// (https://hal.inria.fr/inria-00555588/document)
+//
+// A node only writes its own state, so every node keeps its own replica of
+// a CRDT key, which only holds the updates made by the node. The value of
+// the key in the cluster is the join of the replicas of all the nodes.
+
+// CRDTType is the type of a CRDT.
+type CRDTType string
+
+const (
+	// TypeGCounter is a grow-only counter.
+	TypeGCounter CRDTType = "g-counter"
+	// TypePNCounter is a counter that can be incremented and decremented.
+	TypePNCounter CRDTType = "pn-counter"
+	// TypeORSet is an observed-remove set.
+	TypeORSet CRDTType = "or-set"
+	// TypeLWWRegister is a last-writer-wins register.
+	TypeLWWRegister CRDTType = "lww-register"
+)
+
+// CRDT is a conflict-free replicated data type.
+type CRDT interface {
+	// Type returns the type of the CRDT.
+	Type() CRDTType
+	// Merge returns the join of the CRDT and another CRDT of the same type.
+	// It is commutative, associative and idempotent, and does not modify
+	// any of the CRDTs.
+	Merge(other CRDT) CRDT
+	// Value returns the value of the CRDT.
+	Value() interface{}
+}
+
+// newCRDT returns an empty CRDT of the given type
+func newCRDT(t CRDTType) (CRDT, error) {
+	switch t {
+	case TypeGCounter:
+		return GCounter{}, nil
+	case TypePNCounter:
+		return PNCounter{P: GCounter{}, N: GCounter{}}, nil
+	case TypeORSet:
+		return ORSet{Adds: map[string][]string{}, Removes: map[string][]string{}}, nil
+	case TypeLWWRegister:
+		return LWWRegister{}, nil
+	default:
+		return nil, fmt.Errorf("unknown crdt type %q", t)
+	}
+}
+
+// decodeCRDT decodes the JSON encoding of a CRDT of the given type
+func decodeCRDT(t CRDTType, data []byte) (CRDT, error) {
+	switch t {
+	case TypeGCounter:
+		var c GCounter
+		err := json.Unmarshal(data, &c)
+		return c, err
+	case TypePNCounter:
+		var c PNCounter
+		err := json.Unmarshal(data, &c)
+		return c, err
+	case TypeORSet:
+		var c ORSet
+		err := json.Unmarshal(data, &c)
+		return c, err
+	case TypeLWWRegister:
+		var c LWWRegister
+		err := json.Unmarshal(data, &c)
+		return c, err
+	default:
+		return nil, fmt.Errorf("unknown crdt type %q", t)
+	}
+}
+
+// GCounter is a grow-only counter. It holds the count of every node.
+type GCounter map[string]uint64
+
+var _ CRDT = GCounter{}
+
+// Type returns the type of the CRDT
+func (c GCounter) Type() CRDTType {
+	return TypeGCounter
+}
+
+// Merge returns the join of the two counters, the highest count of every node
+func (c GCounter) Merge(other CRDT) CRDT {
+	return c.merge(other.(GCounter))
+}
+
+// merge returns the join of the two counters
+func (c GCounter) merge(other GCounter) GCounter {
+	result := make(GCounter, len(c))
+	for node, count := range c {
+		result[node] = count
+	}
+	for node, count := range other {
+		if count > result[node] {
+			result[node] = count
+		}
+	}
+	return result
+}
+
+// Value returns the sum of the counts
+func (c GCounter) Value() interface{} {
+	return c.sum()
+}
+
+// sum returns the sum of the counts
+func (c GCounter) sum() uint64 {
+	var sum uint64
+	for _, count := range c {
+		sum += count
+	}
+	return sum
+}
+
+// increment returns the counter incremented by the given node
+func (c GCounter) increment(node string, delta uint64) GCounter {
+	result := c.merge(GCounter{})
+	result[node] += delta
+	return result
+}
+
+// PNCounter is a counter that can be incremented and decremented.
+// It holds a counter of the increments and a counter of the decrements.
+type PNCounter struct {
+	// P counts the increments.
+	P GCounter `json:"p"`
+	// N counts the decrements.
+	N GCounter `json:"n"`
+}
+
+var _ CRDT = PNCounter{}
+
+// Type returns the type of the CRDT
+func (c PNCounter) Type() CRDTType {
+	return TypePNCounter
+}
+
+// Merge returns the join of the two counters
+func (c PNCounter) Merge(other CRDT) CRDT {
+	o := other.(PNCounter)
+	return PNCounter{
+		P: c.P.merge(o.P),
+		N: c.N.merge(o.N),
+	}
+}
+
+// Value returns the increments minus the decrements
+func (c PNCounter) Value() interface{} {
+	return int64(c.P.sum()) - int64(c.N.sum())
+}
+
+// increment returns the counter incremented by the given node.
+// A negative delta decrements the counter.
+func (c PNCounter) increment(node string, delta int64) PNCounter {
+	if delta < 0 {
+		return PNCounter{P: c.P.merge(GCounter{}), N: c.N.increment(node, uint64(-delta))}
+	}
+	return PNCounter{P: c.P.increment(node, uint64(delta)), N: c.N.merge(GCounter{})}
+}
+
+// ORSet is an observed-remove set. Every add of an element is identified
+// by a unique tag, and a remove only removes the tags it observed, so an
+// element added concurrently with its removal stays in the set.
+type ORSet struct {
+	// Adds are the tags of the adds of each element.
+	Adds map[string][]string `json:"adds"`
+	// Removes are the removed tags of each element.
+	Removes map[string][]string `json:"removes"`
+}
+
+var _ CRDT = ORSet{}
+
+// Type returns the type of the CRDT
+func (s ORSet) Type() CRDTType {
+	return TypeORSet
+}
+
+// Merge returns the join of the two sets
+func (s ORSet) Merge(other CRDT) CRDT {
+	o := other.(ORSet)
+	return ORSet{
+		Adds:    unionTags(s.Adds, o.Adds),
+		Removes: unionTags(s.Removes, o.Removes),
+	}
+}
+
+// Value returns the sorted elements of the set
+func (s ORSet) Value() interface{} {
+	return s.elements()
+}
+
+// elements returns the sorted elements of the set
+func (s ORSet) elements() []string {
+	result := []string{}
+	for element := range s.Adds {
+		if len(s.observed(element)) > 0 {
+			result = append(result, element)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// observed returns the tags of the element that were not removed
+func (s ORSet) observed(element string) []string {
+	removed := make(map[string]bool)
+	for _, tag := range s.Removes[element] {
+		removed[tag] = true
+	}
+	var result []string
+	for _, tag := range s.Adds[element] {
+		if !removed[tag] {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// add returns the set with the element added with the given tag
+func (s ORSet) add(element string, tag string) ORSet {
+	return s.Merge(ORSet{Adds: map[string][]string{element: {tag}}}).(ORSet)
+}
+
+// remove returns the set with the given tags of the element removed
+func (s ORSet) remove(element string, tags []string) ORSet {
+	return s.Merge(ORSet{Removes: map[string][]string{element: tags}}).(ORSet)
+}
+
+// unionTags returns the union of the tags of each element
+func unionTags(a, b map[string][]string) map[string][]string {
+	result := make(map[string][]string)
+	for _, tags := range []map[string][]string{a, b} {
+		for element, elementTags := range tags {
+			result[element] = append(result[element], elementTags...)
+		}
+	}
+	for element, tags := range result {
+		sort.Strings(tags)
+		unique := tags[:0]
+		for i, tag := range tags {
+			if i == 0 || tag != tags[i-1] {
+				unique = append(unique, tag)
+			}
+		}
+		result[element] = unique
+	}
+	return result
+}
+
+// LWWRegister is a last-writer-wins register.
+type LWWRegister struct {
+	// Content is the value of the register.
+	Content string `json:"value"`
+	// Version is the version of the last write.
+	Version Version `json:"version"`
+}
+
+var _ CRDT = LWWRegister{}
+
+// Type returns the type of the CRDT
+func (r LWWRegister) Type() CRDTType {
+	return TypeLWWRegister
+}
+
+// Merge returns the register with the latest write
+func (r LWWRegister) Merge(other CRDT) CRDT {
+	o := other.(LWWRegister)
+	if o.Version.After(r.Version) {
+		return o
+	}
+	return r
+}
+
+// Value returns the value of the register
+func (r LWWRegister) Value() interface{} {
+	return r.Content
+}
@@ -0,0 +1,152 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCRDTMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      CRDT
+		b      CRDT
+		expect interface{}
+	}{
+		{
+			name:   "g-counter",
+			a:      GCounter{"a": 2, "b": 1},
+			b:      GCounter{"b": 3},
+			expect: uint64(5),
+		}, {
+			name:   "pn-counter",
+			a:      PNCounter{P: GCounter{"a": 2}, N: GCounter{"a": 1}},
+			b:      PNCounter{P: GCounter{"b": 1}, N: GCounter{"b": 4}},
+			expect: int64(-2),
+		}, {
+			name: "or-set",
+			a: ORSet{
+				Adds:    map[string][]string{"x": {"a/1"}, "y": {"a/2"}},
+				Removes: map[string][]string{},
+			},
+			b: ORSet{
+				Adds:    map[string][]string{"z": {"b/1"}},
+				Removes: map[string][]string{"y": {"a/2"}},
+			},
+			expect: []string{"x", "z"},
+		}, {
+			name:   "lww-register",
+			a:      LWWRegister{Content: "a", Version: Version{Time: 2, Node: "a"}},
+			b:      LWWRegister{Content: "b", Version: Version{Time: 1, Node: "b"}},
+			expect: "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := tt.a.Merge(tt.b)
+			ba := tt.b.Merge(tt.a)
+			assert.Equal(t, tt.expect, ab.Value())
+			assert.Equal(t, ab, ba, "merge is commutative")
+			assert.Equal(t, ab, ab.Merge(tt.b), "merge is idempotent")
+		})
+	}
+}
+
+func TestORSetAddWins(t *testing.T) {
+	s := ORSet{}.add("x", "a/1")
+	// one node removes x while another one adds it again
+	removed := s.remove("x", s.observed("x"))
+	added := s.add("x", "b/1")
+	assert.Equal(t, []string{"x"}, removed.Merge(added).Value())
+	assert.Equal(t, []string{}, removed.Value())
+}
+
+func TestVersionedStrJSON(t *testing.T) {
+	values := []*VersionedStr{
+		{Version: Version{Time: 1, Node: "a"}, Value: "a"},
+		{Version: Version{Time: 1, Node: "a"}, CRDT: GCounter{"a": 1}},
+		{Version: Version{Time: 1, Node: "a"}, CRDT: PNCounter{P: GCounter{"a": 1}, N: GCounter{}}},
+		{Version: Version{Time: 1, Node: "a"}, CRDT: ORSet{Adds: map[string][]string{"x": {"a/1"}}, Removes: map[string][]string{}}},
+		{Version: Version{Time: 1, Node: "a"}, CRDT: LWWRegister{Content: "a", Version: Version{Time: 1, Node: "a"}}},
+	}
+	for _, v := range values {
+		jsonBytes, err := json.Marshal(v)
+		assert.NoError(t, err)
+		var decoded VersionedStr
+		assert.NoError(t, json.Unmarshal(jsonBytes, &decoded))
+		assert.Equal(t, v, &decoded)
+	}
+}
+
+func Test_mergeCRDT(t *testing.T) {
+	to := ClusterMetadata{
+		"a": NodeState{
+			"c": &VersionedStr{Version: Version{Time: 2, Node: "a"}, CRDT: GCounter{"a": 1}},
+		},
+	}
+	from := ClusterMetadata{
+		"a": NodeState{
+			"c": &VersionedStr{Version: Version{Time: 1, Node: "a"}, CRDT: GCounter{"a": 5}},
+		},
+	}
+	merge(to, from, time.Now())
+	assert.Equal(t, &VersionedStr{Version: Version{Time: 2, Node: "a"}, CRDT: GCounter{"a": 5}}, to["a"]["c"])
+}
+
+func TestServerCRDT(t *testing.T) {
+	a := newTestServer("a", time.Now)
+	b := newTestServer("b", time.Now)
+
+	assert.NoError(t, a.incrementCounter("hits", TypePNCounter, 3))
+	assert.NoError(t, b.incrementCounter("hits", TypePNCounter, -1))
+	assert.NoError(t, a.addElement("set", "x"))
+	assert.NoError(t, a.setRegister("reg", "a"))
+	merge(b.metadata, a.metadata, time.Now())
+	assert.NoError(t, b.removeElement("set", "x"))
+	assert.NoError(t, b.addElement("set", "y"))
+	assert.NoError(t, b.setRegister("reg", "b"))
+	merge(a.metadata, b.metadata, time.Now())
+
+	for _, s := range []*Server{a, b} {
+		hits, err := s.crdt("hits")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), hits.Value())
+		set, err := s.crdt("set")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"y"}, set.Value())
+		reg, err := s.crdt("reg")
+		assert.NoError(t, err)
+		assert.Equal(t, "b", reg.Value())
+	}
+
+	assert.ErrorIs(t, a.incrementCounter("set", TypeGCounter, 1), errCRDTType)
+	assert.ErrorIs(t, a.addElement("hits", "x"), errCRDTType)
+	assert.Error(t, a.incrementCounter("g", TypeGCounter, -1))
+	_, err := a.crdt("missing")
+	assert.ErrorIs(t, err, errCRDTNotFound)
+}
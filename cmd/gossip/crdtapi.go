@@ -0,0 +1,282 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+var (
+	// errCRDTType is returned when a key is used as a CRDT of another type
+	errCRDTType = errors.New("crdt type mismatch")
+	// errCRDTNotFound is returned when a CRDT key does not exist
+	errCRDTNotFound = errors.New("crdt not found")
+)
+
+// crdtRequest is the body of the requests to the CRDT endpoints
+type crdtRequest struct {
+	// Key is the key of the CRDT.
+	Key string `json:"key"`
+	// Type is the type of the counter to increment.
+	Type CRDTType `json:"type,omitempty"`
+	// Delta is the increment of a counter.
+	Delta int64 `json:"delta,omitempty"`
+	// Element is the element to add to or remove from a set.
+	Element string `json:"element,omitempty"`
+	// Value is the value of a register.
+	Value string `json:"value,omitempty"`
+}
+
+// crdtResponse is the value of a CRDT key in the cluster
+type crdtResponse struct {
+	// Key is the key of the CRDT.
+	Key string `json:"key"`
+	// Type is the type of the CRDT.
+	Type CRDTType `json:"type"`
+	// Value is the value of the CRDT.
+	Value interface{} `json:"value"`
+}
+
+// crdt returns the value of a CRDT key in the cluster, the join of the
+// replicas of all the nodes. It must be called with the lock held.
+func (s *Server) crdt(key string) (CRDT, error) {
+	var nodeIds []string
+	for nodeId := range s.metadata {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Strings(nodeIds)
+
+	var result CRDT
+	for _, nodeId := range nodeIds {
+		v, ok := s.metadata[nodeId][key]
+		if !ok || v.Deleted {
+			continue
+		}
+		if v.CRDT == nil {
+			return nil, fmt.Errorf("%w: %q is a string on %s", errCRDTType, key, nodeId)
+		}
+		if result == nil {
+			result = v.CRDT
+			continue
+		}
+		if v.CRDT.Type() != result.Type() {
+			return nil, fmt.Errorf("%w: %q is a %s on %s", errCRDTType, key, v.CRDT.Type(), nodeId)
+		}
+		result = result.Merge(v.CRDT)
+	}
+	if result == nil {
+		return nil, fmt.Errorf("%w: %q", errCRDTNotFound, key)
+	}
+	return result, nil
+}
+
+// localCRDT returns the local replica of a CRDT key, or an empty CRDT
+// of the given type if it does not exist. It must be called with the lock held.
+func (s *Server) localCRDT(key string, t CRDTType) (CRDT, error) {
+	cluster, err := s.crdt(key)
+	if err != nil && !errors.Is(err, errCRDTNotFound) {
+		return nil, err
+	}
+	if cluster != nil && cluster.Type() != t {
+		return nil, fmt.Errorf("%w: %q is a %s", errCRDTType, key, cluster.Type())
+	}
+	if v, ok := s.metadata[s.id][key]; ok && !v.Deleted {
+		return v.CRDT, nil
+	}
+	return newCRDT(t)
+}
+
+// setLocalCRDT writes the local replica of a CRDT key, unless its
+// encoding would exceed the maximum value length, since the sets
+// keep growing with their adds and removes.
+// It must be called with the lock held.
+func (s *Server) setLocalCRDT(key string, crdt CRDT, version Version) error {
+	if size := crdtSize(crdt); size > s.config.MaxValueLength {
+		return fmt.Errorf("%w: %s would take %d bytes, more than %d", errTooLarge, key, size, s.config.MaxValueLength)
+	}
+	if s.metadata[s.id] == nil {
+		s.metadata[s.id] = make(NodeState)
+	}
+	var oldVersion Version
+	if old, ok := s.metadata[s.id][key]; ok {
+		oldVersion = old.Version
+	}
+	v := &VersionedStr{
+		Version: version,
+		CRDT:    crdt,
+	}
+	s.metadata[s.id][key] = v
+	s.written(key, oldVersion, v)
+	return nil
+}
+
+// incrementCounter increments a counter of the given type.
+// It must be called with the lock held.
+func (s *Server) incrementCounter(key string, t CRDTType, delta int64) error {
+	local, err := s.localCRDT(key, t)
+	if err != nil {
+		return err
+	}
+	switch c := local.(type) {
+	case GCounter:
+		if delta < 0 {
+			return fmt.Errorf("cannot decrement the g-counter %q", key)
+		}
+		return s.setLocalCRDT(key, c.increment(s.id, uint64(delta)), s.clock.Now())
+	case PNCounter:
+		return s.setLocalCRDT(key, c.increment(s.id, delta), s.clock.Now())
+	default:
+		return fmt.Errorf("%s is not a counter type", t)
+	}
+}
+
+// addElement adds an element to a set.
+// It must be called with the lock held.
+func (s *Server) addElement(key string, element string) error {
+	local, err := s.localCRDT(key, TypeORSet)
+	if err != nil {
+		return err
+	}
+	// the version of the write is unique, so it also tags the add
+	version := s.clock.Now()
+	tag := fmt.Sprintf("%s/%d/%d", version.Node, version.Time, version.Counter)
+	return s.setLocalCRDT(key, local.(ORSet).add(element, tag), version)
+}
+
+// removeElement removes an element from a set, by removing
+// the tags of the element observed in the cluster.
+// It must be called with the lock held.
+func (s *Server) removeElement(key string, element string) error {
+	local, err := s.localCRDT(key, TypeORSet)
+	if err != nil {
+		return err
+	}
+	cluster, err := s.crdt(key)
+	if err != nil {
+		return err
+	}
+	observed := cluster.(ORSet).observed(element)
+	if len(observed) == 0 {
+		return nil
+	}
+	return s.setLocalCRDT(key, local.(ORSet).remove(element, observed), s.clock.Now())
+}
+
+// setRegister sets the value of a register.
+// It must be called with the lock held.
+func (s *Server) setRegister(key string, value string) error {
+	if _, err := s.localCRDT(key, TypeLWWRegister); err != nil {
+		return err
+	}
+	version := s.clock.Now()
+	return s.setLocalCRDT(key, LWWRegister{Content: value, Version: version}, version)
+}
+
+// getCRDT handles the requests for the value of a CRDT key
+func (s *Server) getCRDT(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	crdt, err := s.crdt(key)
+	if err != nil {
+		http.Error(w, err.Error(), crdtErrorStatus(err))
+		return
+	}
+	resp := crdtResponse{Key: key, Type: crdt.Type(), Value: crdt.Value()}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// updateCRDT handles the operations on CRDT keys
+func (s *Server) updateCRDT(w http.ResponseWriter, r *http.Request, op string) {
+	var req crdtRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	var apply func() error
+	switch op {
+	case "increment":
+		apply = func() error { return s.incrementCounter(req.Key, req.Type, req.Delta) }
+	case "add":
+		apply = func() error { return s.addElement(req.Key, req.Element) }
+	case "remove":
+		apply = func() error { return s.removeElement(req.Key, req.Element) }
+	case "set":
+		apply = func() error { return s.setRegister(req.Key, req.Value) }
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	s.lock.Lock()
+	// only one of the element and the value is set
+	err := s.checkWrite(map[string]string{req.Key: req.Element + req.Value})
+	if err == nil {
+		err = apply()
+	}
+	var crdt CRDT
+	if err == nil {
+		crdt, err = s.crdt(req.Key)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), crdtErrorStatus(err))
+		return
+	}
+	// the write is acknowledged once it is on disk
+	s.sync()
+
+	resp := crdtResponse{Key: req.Key, Type: crdt.Type(), Value: crdt.Value()}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// crdtErrorStatus returns the http status of a CRDT error
+func crdtErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCRDTNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errCRDTType):
+		return http.StatusConflict
+	case errors.Is(err, errTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
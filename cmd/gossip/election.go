@@ -0,0 +1,203 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// keyLeader is the key holding the leader seen by a node
+const keyLeader = "gossip_leader"
+
+// leaderBuffer is the number of leadership changes buffered for a subscriber
+const leaderBuffer = 16
+
+// Leadership is the leader of the cluster, as seen by the local node.
+//
+// The leader is the alive member with the lowest id. It is only elected
+// while the node sees a quorum of the members, so that the minority side
+// of a partition has no leader. Each node gossips the leader it sees, and
+// the members seeing another leader are reported as conflicts, such as
+// while a partition heals.
+type Leadership struct {
+	// Leader is the id of the leader, or "" if there is none.
+	Leader string `json:"leader"`
+	// Incarnation is the incarnation of the leader, as seen by the local
+	// node. It is not persisted nor agreed on by the members, so it cannot
+	// order the leaders, such as to fence a previous one.
+	Incarnation int `json:"incarnation"`
+	// Quorum is true if the node sees a quorum of the members.
+	Quorum bool `json:"quorum"`
+	// Conflicts are the alive members that see another leader, sorted.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// equal returns true if the leaderships are the same
+func (l Leadership) equal(other Leadership) bool {
+	if l.Leader != other.Leader || l.Incarnation != other.Incarnation || l.Quorum != other.Quorum ||
+		len(l.Conflicts) != len(other.Conflicts) {
+		return false
+	}
+	for i := range l.Conflicts {
+		if l.Conflicts[i] != other.Conflicts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// quorum returns the number of live members needed to elect a leader, the
+// configured quorum or else a majority of the members that did not leave and
+// did not stay dead for longer than the dead timeout. It must be called with the lock held.
+func (s *Server) quorum(now time.Time) int {
+	if s.config.Quorum > 0 {
+		return s.config.Quorum
+	}
+	// the local node
+	known := 1
+	for _, member := range s.membership {
+		switch member.Status {
+		case StatusLeft:
+		case StatusDead:
+			if now.Sub(member.since) < s.config.DeadTimeout {
+				known++
+			}
+		default:
+			known++
+		}
+	}
+	return known/2 + 1
+}
+
+// elect updates the leader seen by the local node, gossips it, and
+// notifies the subscribers if it changed. It must be called with the lock held.
+func (s *Server) elect() {
+	if !s.config.Election || s.id == "" {
+		return
+	}
+	var next Leadership
+	if !s.left {
+		members := s.members()
+		live := 0
+		for _, member := range members {
+			if member.Status == StatusAlive || member.Status == StatusSuspect {
+				live++
+			}
+		}
+		next.Quorum = live >= s.quorum(s.now())
+		if next.Quorum {
+			// the members are sorted by id
+			for _, member := range members {
+				if member.Status == StatusAlive {
+					next.Leader = member.ID
+					next.Incarnation = member.Incarnation
+					break
+				}
+			}
+		}
+		if next.Leader != "" {
+			for _, member := range members {
+				if member.ID == s.id || member.Status != StatusAlive {
+					continue
+				}
+				if seen, ok := s.metadata[member.ID][keyLeader]; ok && !seen.Deleted && seen.Value != "" && seen.Value != next.Leader {
+					next.Conflicts = append(next.Conflicts, member.ID)
+				}
+			}
+			sort.Strings(next.Conflicts)
+		}
+	}
+	previous := s.leadership
+	if next.equal(previous) {
+		return
+	}
+	s.leadership = next
+	if next.Leader != previous.Leader {
+		s.addLocalState(keyLeader, next.Leader)
+		s.logger.Info("leader changed", "leader", next.Leader, "previous", previous.Leader, "quorum", next.Quorum)
+	}
+	if len(next.Conflicts) > 0 && len(previous.Conflicts) == 0 {
+		s.logger.Warn("members see another leader", "leader", next.Leader, "conflicts", next.Conflicts)
+	}
+	for changes := range s.leaderSubscriptions {
+		select {
+		case changes <- next:
+		default:
+			s.unsubscribeLeader(changes)
+		}
+	}
+}
+
+// Leader returns the leader of the cluster, as seen by the local node.
+// The leader is always empty if the election is not enabled.
+func (s *Server) Leader() Leadership {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.leadership
+}
+
+// IsLeader returns true if the local node is the leader
+func (s *Server) IsLeader() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.id != "" && s.leadership.Leader == s.id
+}
+
+// SubscribeLeader returns a channel that receives the leadership whenever
+// it changes, and a function to cancel the subscription. The channel is
+// closed when the subscription is canceled, or if the subscriber does not
+// keep up with the changes.
+func (s *Server) SubscribeLeader() (<-chan Leadership, func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changes := make(chan Leadership, leaderBuffer)
+	s.leaderSubscriptions[changes] = struct{}{}
+	cancel := func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.unsubscribeLeader(changes)
+	}
+	return changes, cancel
+}
+
+// unsubscribeLeader removes the subscription and closes its channel.
+// It must be called with the lock held.
+func (s *Server) unsubscribeLeader(changes chan Leadership) {
+	if _, ok := s.leaderSubscriptions[changes]; !ok {
+		return
+	}
+	delete(s.leaderSubscriptions, changes)
+	close(changes)
+}
+
+// getLeader writes the leadership seen by the node
+func (s *Server) getLeader(w http.ResponseWriter) {
+	if err := json.NewEncoder(w).Encode(s.Leader()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
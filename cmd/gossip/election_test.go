@@ -0,0 +1,159 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestElect(t *testing.T) {
+	s := newTestServer("b", time.Now)
+	s.config.Election = true
+	changes, cancel := s.SubscribeLeader()
+	defer cancel()
+	now := time.Now()
+	s.applyUpdate(Member{ID: "a", Address: "a", Status: StatusAlive, Incarnation: 2}, now)
+	s.applyUpdate(Member{ID: "c", Address: "c", Status: StatusAlive}, now)
+	s.elect()
+	assert.Equal(t, Leadership{Leader: "a", Incarnation: 2, Quorum: true}, <-changes)
+	assert.False(t, s.IsLeader())
+	assert.Equal(t, "a", s.metadata["b"][keyLeader].Value)
+
+	// a member sees another leader
+	s.metadata["c"] = NodeState{keyLeader: {Value: "c"}}
+	s.elect()
+	assert.Equal(t, Leadership{Leader: "a", Incarnation: 2, Quorum: true, Conflicts: []string{"c"}}, <-changes)
+	s.metadata["c"] = NodeState{keyLeader: {Value: "a"}}
+	s.elect()
+	assert.Equal(t, Leadership{Leader: "a", Incarnation: 2, Quorum: true}, <-changes)
+
+	// the next lowest id is elected when the leader fails
+	s.applyUpdate(Member{ID: "a", Status: StatusSuspect, Incarnation: 2}, now)
+	s.elect()
+	assert.Equal(t, Leadership{Leader: "b", Quorum: true, Conflicts: []string{"c"}}, <-changes)
+	assert.True(t, s.IsLeader())
+
+	// no leader without a quorum
+	s.applyUpdate(Member{ID: "a", Status: StatusDead, Incarnation: 2}, now)
+	s.applyUpdate(Member{ID: "c", Status: StatusDead, Incarnation: 1}, now)
+	s.elect()
+	assert.Equal(t, Leadership{}, <-changes)
+	assert.Equal(t, "", s.metadata["b"][keyLeader].Value)
+
+	// the members that left do not count in the quorum
+	s.applyUpdate(Member{ID: "a", Status: StatusLeft, Incarnation: 3}, now)
+	s.applyUpdate(Member{ID: "c", Status: StatusLeft, Incarnation: 2}, now)
+	s.elect()
+	assert.Equal(t, Leadership{Leader: "b", Quorum: true}, <-changes)
+
+	// nothing changes
+	s.elect()
+	assert.Empty(t, changes)
+}
+
+func TestElectQuorum(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.config.Election = true
+	s.config.Quorum = 2
+	s.elect()
+	assert.Equal(t, Leadership{}, s.Leader())
+
+	s.applyUpdate(Member{ID: "b", Address: "b", Status: StatusAlive}, time.Now())
+	s.elect()
+	assert.Equal(t, Leadership{Leader: "a", Quorum: true}, s.Leader())
+}
+
+func TestSimulationElection(t *testing.T) {
+	sim := NewSimulation(SimConfig{
+		Seed:    5,
+		Nodes:   5,
+		Config:  Config{SuspicionTimeout: 5 * time.Second, SeedInterval: 5 * time.Second, Election: true},
+		Latency: 5 * time.Millisecond,
+		Jitter:  10 * time.Millisecond,
+	})
+	nodes := sim.Nodes()
+	leaders := func(ids []string, leader string) func() bool {
+		return func() bool {
+			for _, id := range ids {
+				l := sim.Server(id).Leader()
+				if l.Leader != leader || len(l.Conflicts) > 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	assert.True(t, sim.RunUntil(leaders(nodes, "node-0"), time.Minute))
+
+	// the minority loses its leader, the majority elects its own
+	sim.Partition(nodes[:2], nodes[2:])
+	assert.True(t, sim.RunUntil(func() bool {
+		return leaders(nodes[:2], "")() && leaders(nodes[2:], "node-2")()
+	}, time.Minute))
+	assert.False(t, sim.Server("node-0").Leader().Quorum)
+
+	// everyone agrees on the first leader again once the partition heals
+	sim.Heal()
+	assert.True(t, sim.RunUntil(leaders(nodes, "node-0"), time.Minute))
+}
+
+func TestSimulationElectionReplaced(t *testing.T) {
+	sim := NewSimulation(SimConfig{
+		Seed:    6,
+		Nodes:   3,
+		Config:  Config{SuspicionTimeout: 5 * time.Second, DeadTimeout: time.Minute, Election: true},
+		Latency: 5 * time.Millisecond,
+		Jitter:  10 * time.Millisecond,
+	})
+	hasLeader := func() bool {
+		var leader string
+		for _, id := range sim.Nodes() {
+			if _, ok := sim.handlers[id]; !ok {
+				continue
+			}
+			l := sim.Server(id).Leader()
+			if l.Leader == "" || len(l.Conflicts) > 0 || (leader != "" && l.Leader != leader) {
+				return false
+			}
+			leader = l.Leader
+		}
+		return true
+	}
+	assert.True(t, sim.RunUntil(hasLeader, time.Minute))
+
+	// the nodes are replaced one by one, until the dead ones outnumber the live ones
+	for _, id := range sim.Nodes() {
+		sim.Stop(id)
+		sim.Add()
+		sim.Run(20 * time.Second)
+	}
+	assert.Equal(t, "", sim.Server("node-5").Leader().Leader)
+
+	// the dead members stop counting in the quorum
+	assert.True(t, sim.RunUntil(hasLeader, 2*time.Minute))
+	assert.Equal(t, "node-3", sim.Server("node-5").Leader().Leader)
+}
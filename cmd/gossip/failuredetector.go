@@ -0,0 +1,122 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// phiWindowSize is the number of heartbeat intervals kept by the failure detector.
+	phiWindowSize = 100
+	// phiSuspectThreshold is the phi value above which a node is considered suspect.
+	phiSuspectThreshold = 5
+	// phiDeadThreshold is the phi value above which a node is considered dead.
+	phiDeadThreshold = 8
+	// phiInitialInterval is the heartbeat interval assumed before any interval was observed.
+	phiInitialInterval = time.Second
+)
+
+// NodeStatus is the liveness status of a node, as seen by the local node.
+type NodeStatus string
+
+const (
+	// StatusAlive is the status of a node that heartbeats regularly.
+	StatusAlive NodeStatus = "alive"
+	// StatusSuspect is the status of a node that missed some heartbeats.
+	StatusSuspect NodeStatus = "suspect"
+	// StatusDead is the status of a node that is considered failed.
+	StatusDead NodeStatus = "dead"
+	// StatusLeft is the status of a node that left the cluster on purpose.
+	StatusLeft NodeStatus = "left"
+)
+
+// phiDetector is a phi accrual failure detector.
+//
+// Instead of a boolean alive/dead answer, it outputs a suspicion level (phi)
+// derived from the distribution of the past heartbeat inter-arrival times.
+// The inter-arrival times are modeled with an exponential distribution, so
+// phi = -log10(P(no heartbeat for t)) = t / mean * log10(e)
+type phiDetector struct {
+	// intervals is a sliding window of the last heartbeat intervals.
+	intervals []time.Duration
+	// last is the arrival time of the last heartbeat.
+	last time.Time
+}
+
+// newPhiDetector creates a new failure detector that considers the
+// node alive at the given time.
+func newPhiDetector(now time.Time) *phiDetector {
+	return &phiDetector{
+		last: now,
+	}
+}
+
+// heartbeat records the arrival of a heartbeat
+func (d *phiDetector) heartbeat(now time.Time) {
+	d.intervals = append(d.intervals, now.Sub(d.last))
+	if len(d.intervals) > phiWindowSize {
+		d.intervals = d.intervals[len(d.intervals)-phiWindowSize:]
+	}
+	d.last = now
+}
+
+// mean returns the mean heartbeat interval
+func (d *phiDetector) mean() time.Duration {
+	if len(d.intervals) == 0 {
+		return phiInitialInterval
+	}
+	var sum time.Duration
+	for _, interval := range d.intervals {
+		sum += interval
+	}
+	mean := sum / time.Duration(len(d.intervals))
+	if mean <= 0 {
+		return phiInitialInterval
+	}
+	return mean
+}
+
+// phi returns the suspicion level of the node at the given time
+func (d *phiDetector) phi(now time.Time) float64 {
+	elapsed := now.Sub(d.last)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(d.mean()) * math.Log10(math.E)
+}
+
+// status returns the status of the node at the given time
+func (d *phiDetector) status(now time.Time) NodeStatus {
+	phi := d.phi(now)
+	if phi >= phiDeadThreshold {
+		return StatusDead
+	}
+	if phi >= phiSuspectThreshold {
+		return StatusSuspect
+	}
+	return StatusAlive
+}
@@ -0,0 +1,77 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPhiDetector(t *testing.T) {
+	start := time.Unix(0, 0)
+	d := newPhiDetector(start)
+	now := start
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		d.heartbeat(now)
+	}
+
+	assert.Equal(t, time.Second, d.mean())
+	assert.Equal(t, 0.0, d.phi(now))
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		expect  NodeStatus
+	}{
+		{
+			name:    "on time",
+			elapsed: time.Second,
+			expect:  StatusAlive,
+		}, {
+			name:    "late",
+			elapsed: 15 * time.Second,
+			expect:  StatusSuspect,
+		}, {
+			name:    "missing",
+			elapsed: 30 * time.Second,
+			expect:  StatusDead,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, d.status(now.Add(tt.elapsed)))
+		})
+	}
+}
+
+func TestPhiDetectorRecovers(t *testing.T) {
+	start := time.Unix(0, 0)
+	d := newPhiDetector(start)
+	assert.Equal(t, StatusDead, d.status(start.Add(time.Minute)))
+	d.heartbeat(start.Add(time.Minute))
+	assert.Equal(t, StatusAlive, d.status(start.Add(time.Minute+time.Second)))
+}
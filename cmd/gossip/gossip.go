@@ -28,137 +28,761 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	keyAddress = "gossip_address"
+	// keyReservedPrefix is the prefix of the keys of the protocol,
+	// that the users cannot write
+	keyReservedPrefix = "gossip_"
+	keyAddress        = "gossip_address"
+	keyHeartbeat      = "gossip_heartbeat"
 )
 
 // Server is the main struct of the gossip package.
 type Server struct {
 	// metadata is the metadata of the server.
 	metadata ClusterMetadata
-	// listener is the listener of the server.
-	listener net.Listener
 	// id is the id of the gossip server.
 	id string
-	// seedNodes are the initial seed nodes of the gossip server.
+	// seedNodes are the seed nodes of the gossip server, as last polled.
 	seedNodes []string
-	lock      sync.RWMutex
+	// seedAddrs are the addresses of each seed node, with its host resolved.
+	seedAddrs map[string][]string
+	// resolver resolves the hosts of the seed nodes.
+	resolver Resolver
+	// seedProviders provide the seed nodes.
+	seedProviders []SeedProvider
+	// lastSeeds are the seeds last returned by each provider. They are
+	// only used by the seed polling loop.
+	lastSeeds map[int][]string
+	// config is the configuration of the gossip server.
+	config Config
+	// transport carries the messages to the other nodes.
+	transport Transport
+	// store persists the state in the data directory, if any.
+	store *store
+	// metrics are the counters exposed on /metrics.
+	metrics *metrics
+	// logger logs the events of the node, with its id.
+	logger *nodeLogger
+	// limiter limits the rate of the messages of each node.
+	limiter *rateLimiter
+	// clock assigns the versions of the local writes.
+	clock Clock
+	// incarnation is the incarnation number of the local node.
+	incarnation int
+	// left is true once the local node left the cluster.
+	left bool
+	// heartbeat is the heartbeat counter of the local node.
+	heartbeat int
+	// membership is the membership state of the remote nodes.
+	membership map[string]*memberState
+	// broadcasts are the membership updates to piggyback on outgoing messages.
+	broadcasts *broadcastQueue
+	// subscriptions are the subscriptions to the changes of the metadata.
+	subscriptions map[*subscription]struct{}
+	// detectors are the failure detectors of the remote nodes.
+	detectors map[string]*phiDetector
+	// heartbeats are the last observed heartbeat versions of the remote nodes.
+	heartbeats map[string]Version
+	// now returns the current time.
+	now func() time.Time
+	// rand selects the nodes to contact. It is guarded by the lock.
+	rand *rand.Rand
+	// serial exchanges messages with one node at a time instead of
+	// concurrently, so that simulations are deterministic.
+	serial bool
+	// leadership is the leader seen by the local node.
+	leadership Leadership
+	// leaderSubscriptions receive the changes of the leadership.
+	leaderSubscriptions map[chan Leadership]struct{}
+	// ringStale is true if the members or their tags changed
+	// since the hashing ring was last updated.
+	ringStale bool
+	// snapshotLock serializes the snapshots. It is taken before lock.
+	snapshotLock sync.Mutex
+	lock         sync.RWMutex
+}
+
+// Member is a node of the cluster, as seen by the local node.
+type Member struct {
+	// ID is the id of the node.
+	ID string `json:"id"`
+	// Address is the gossip address of the node.
+	Address string `json:"address"`
+	// Status is the liveness status of the node.
+	Status NodeStatus `json:"status"`
+	// Incarnation is the incarnation number of the node. Only the node
+	// itself increments it, to refute suspicions about it.
+	Incarnation int `json:"incarnation"`
+	// Tags are the tags of the node, read from its gossiped state.
+	// They are not part of the membership updates.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// State is the state of the cluster, as seen by the local node.
+type State struct {
+	// Metadata is the gossiped metadata of the cluster.
+	Metadata ClusterMetadata `json:"metadata"`
+	// Members are the known nodes of the cluster.
+	Members []Member `json:"members"`
 }
 
 // NewServer creates a new gossip server.
-func NewServer(seedNodes []string) *Server {
+func NewServer(seedNodes []string, config Config) *Server {
+	config = config.withDefaults()
+	transport := config.Transport
+	if transport == nil {
+		transport = NewHTTPTransport()
+	}
+	var providers []SeedProvider
+	if len(seedNodes) > 0 {
+		providers = append(providers, StaticSeeds(seedNodes))
+	}
+	providers = append(providers, config.SeedProviders...)
 	return &Server{
-		metadata:  make(ClusterMetadata),
-		seedNodes: seedNodes,
+		metadata:            make(ClusterMetadata),
+		seedNodes:           seedNodes,
+		seedProviders:       providers,
+		lastSeeds:           make(map[int][]string),
+		resolver:            net.DefaultResolver,
+		config:              config,
+		transport:           transport,
+		membership:          make(map[string]*memberState),
+		broadcasts:          newBroadcastQueue(),
+		subscriptions:       make(map[*subscription]struct{}),
+		leaderSubscriptions: make(map[chan Leadership]struct{}),
+		detectors:           make(map[string]*phiDetector),
+		heartbeats:          make(map[string]Version),
+		metrics:             newMetrics(),
+		logger:              newNodeLogger(config.Logger),
+		limiter:             newRateLimiter(config.RateLimit, config.RateBurst),
+		now:                 time.Now,
+		rand:                rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
 // addLocalState adds a key value pair to the local node state
 func (s *Server) addLocalState(key string, value string) {
+	s.addLocalStateTTL(key, value, 0)
+}
+
+// addLocalStateTTL adds a key value pair to the local node state,
+// expiring after the given ttl if it is positive
+func (s *Server) addLocalStateTTL(key string, value string, ttl time.Duration) {
 	if s.metadata[s.id] == nil {
 		s.metadata[s.id] = make(map[string]*VersionedStr)
 	}
-	if s.metadata[s.id][key] == nil {
-		s.metadata[s.id][key] = newVersionedStr(value)
-	} else {
-		s.metadata[s.id][key].set(value)
+	v := s.metadata[s.id][key]
+	if v == nil {
+		v = newVersionedStr(value, s.clock.Now())
+		v.Expires = expiry(v.Version, ttl)
+		s.metadata[s.id][key] = v
+		s.written(key, Version{}, v)
+	} else if v.changes(value, ttl) {
+		oldVersion := v.Version
+		v.set(value, s.clock.Now(), ttl)
+		s.written(key, oldVersion, v)
+	}
+}
+
+// deleteLocalState deletes a key from the local node state
+// by replacing its value with a tombstone
+func (s *Server) deleteLocalState(key string) {
+	v, ok := s.metadata[s.id][key]
+	if !ok || v.Deleted {
+		return
+	}
+	oldVersion := v.Version
+	v.delete(s.clock.Now())
+	s.written(key, oldVersion, v)
+}
+
+// written publishes a write of the local node state, and appends
+// it to the write-ahead log, to be synced by the next call to sync.
+// The heartbeat changes every round, it is not worth a sync of its
+// own and is synced with the next other write.
+// It must be called with the lock held.
+func (s *Server) written(key string, oldVersion Version, v *VersionedStr) {
+	s.publish(newEvent(s.id, key, oldVersion, v))
+	if s.store == nil {
+		return
+	}
+	if err := s.store.append(s.id, key, v, key != keyHeartbeat); err != nil {
+		s.logger.Error("error writing wal", "key", key, "error", err)
+	}
+}
+
+// sync waits until the local writes are on disk, if there is a data
+// directory. It must be called without the lock, the concurrent
+// syncs are batched.
+func (s *Server) sync() {
+	s.lock.RLock()
+	st := s.store
+	s.lock.RUnlock()
+	if st == nil {
+		return
 	}
+	if err := st.sync(); err != nil {
+		s.logger.Error("error syncing wal", "error", err)
+	}
+}
+
+// beat increments the heartbeat of the local node
+func (s *Server) beat() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.heartbeat++
+	s.addLocalState(keyHeartbeat, strconv.Itoa(s.heartbeat))
+}
+
+// collectTombstones removes the tombstones older than the grace period
+func (s *Server) collectTombstones(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	collectTombstones(s.metadata, now.Add(-s.config.TombstoneGrace))
+}
+
+// collectExpired removes the expired entries
+func (s *Server) collectExpired(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	collectExpired(s.metadata, now)
 }
 
 // doGossip performs the gossip protocol
-func (s *Server) doGossip() {
+func (s *Server) doGossip(ctx context.Context) {
+	s.lock.RLock()
+	left := s.left
+	s.lock.RUnlock()
+	if left {
+		// the node does not gossip anymore
+		return
+	}
+	start := s.now()
+	defer func() {
+		s.metrics.round(s.now().Sub(start))
+	}()
+	s.beat()
+	s.collectTombstones(s.now())
+	s.collectExpired(s.now())
+	s.lock.Lock()
 	liveNodes := s.liveNodes()
+	var nodes []string
 	if len(liveNodes) == 0 {
 		// seed
-		s.gossip(randomNode(s.seedNodes))
+		nodes = randomNodes(s.rand, s.seedNodes, s.config.Fanout)
 	} else {
 		// gossip
-		s.gossip(randomNode(liveNodes))
+		nodes = randomNodes(s.rand, liveNodes, s.config.Fanout)
+	}
+	s.lock.Unlock()
+	if s.serial {
+		for _, node := range nodes {
+			s.gossip(ctx, node)
+		}
+		return
 	}
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			s.gossip(ctx, node)
+		}(node)
+	}
+	wg.Wait()
 }
 
 // randomNode selects a random node from the list of given nodes
-func randomNode(nodes []string) string {
+func randomNode(r *rand.Rand, nodes []string) string {
 	if len(nodes) == 0 {
 		return ""
 	}
-	i := rand.Intn(len(nodes))
+	i := r.Intn(len(nodes))
 	return nodes[i]
 }
 
-// gossip performs gossip with the given node
-func (s *Server) gossip(node string) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+// randomNodes selects up to k random nodes from the list of given nodes
+func randomNodes(r *rand.Rand, nodes []string, k int) []string {
+	var result []string
+	for _, i := range r.Perm(len(nodes)) {
+		if len(result) == k {
+			break
+		}
+		result = append(result, nodes[i])
+	}
+	return result
+}
 
+// gossip performs gossip with the given node
+//
+// The exchange is done in three phases, so that only the
+// entries that changed are sent over the wire:
+//   - SYN: we send the digest of our metadata
+//   - ACK: the node responds with the entries we are missing, and
+//     the digest of the entries it is missing
+//   - ACK2: we send the entries the node is missing
+//
+// In push mode, the node does not send the entries we are missing,
+// and in pull mode, it does not ask for the entries it is missing.
+func (s *Server) gossip(ctx context.Context, node string) {
 	if node == "" {
 		return
 	}
-	jsonBytes, err := json.Marshal(s.metadata)
+	// the lock is not held while waiting for the peer, otherwise two
+	// nodes gossiping with each other at the same time would deadlock
+	s.lock.Lock()
+	syn := s.newMessage(MessageSyn)
+	syn.Digest = digest(s.metadata)
+	syn.Mode = s.config.Mode
+	s.lock.Unlock()
+
+	ack, err := s.send(ctx, node, syn)
 	if err != nil {
-		fmt.Println("error marshalling metadata", err)
+		s.logger.Warn("error sending gossip", "peer", node, "error", err)
 		return
 	}
-	resp, err := http.Post(fmt.Sprintf("http://%s/gossip", node), "application/json", bytes.NewBuffer(jsonBytes))
-	if err != nil {
-		fmt.Println("error sending gossip to", node, err)
+
+	s.lock.Lock()
+	s.receive(ack, s.now())
+	if len(ack.Digest) == 0 {
+		s.lock.Unlock()
 		return
 	}
+	ack2 := s.newMessage(MessageAck2)
+	ack2.Metadata = requested(s.metadata, ack.Digest)
+	s.lock.Unlock()
 
-	respBytes, err := ioutil.ReadAll(resp.Body)
+	resp, err := s.send(ctx, node, ack2)
 	if err != nil {
-		fmt.Println("error reading response body", err)
+		s.logger.Warn("error sending ack2", "peer", node, "error", err)
 		return
 	}
 
-	var newMetadata ClusterMetadata
-	err = json.Unmarshal(respBytes, &newMetadata)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.receive(resp, s.now())
+
+}
+
+// ack returns the response to a SYN.
+// It must be called with the lock held.
+func (s *Server) ack(syn *Message) *Message {
+	mode := syn.Mode
+	if mode == "" {
+		mode = ModePushPull
+	}
+	ack := s.newMessage(MessageAck)
+	if mode.pulls() {
+		ack.Metadata = deltaSince(s.metadata, syn.Digest)
+	}
+	if mode.pushes() {
+		ack.Digest = outdated(s.metadata, syn.Digest)
+	}
+	return ack
+}
+
+// newMessage returns a new message of the given type from the local node,
+// with piggybacked membership updates. It must be called with the lock held.
+func (s *Server) newMessage(msgType MessageType) *Message {
+	return &Message{
+		Type:    msgType,
+		From:    s.id,
+		Members: s.broadcasts.take(maxPiggyback, s.maxTransmits()),
+	}
+}
+
+// deadlineKey is the context key of the deadline
+// of a request, measured by the clock of the server
+type deadlineKey struct{}
+
+// withTimeout returns a context that expires after the given duration. The
+// deadline measured by the clock of the server is kept in the context too,
+// so that simulated transports can tell when the request times out.
+func (s *Server) withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	deadline := s.now().Add(d)
+	if parent, ok := ctx.Value(deadlineKey{}).(time.Time); !ok || deadline.Before(parent) {
+		ctx = context.WithValue(ctx, deadlineKey{}, deadline)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// send sends the given message to the given node and returns its response
+func (s *Server) send(ctx context.Context, node string, msg *Message) (*Message, error) {
+	ctx, cancel := s.withTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	msg, err := s.seal(msg)
 	if err != nil {
-		fmt.Println("error unmarshalling response", err)
-		return
+		return nil, err
+	}
+	resp, err := s.transport.Send(ctx, node, msg)
+	if err != nil {
+		s.metrics.add(&s.metrics.sendErrors, 1)
+		if errors.Is(err, errTooLarge) {
+			// it would fail every round, such as a delta too large for a datagram
+			s.logger.Error("message too large for the transport, it is not sent", "peer", node, "type", msg.Type, "error", err)
+		}
+		return nil, err
+	}
+	return s.open(resp)
+}
+
+// handle handles a message received from another node, and returns the
+// response. A message that makes the node panic is logged and answered with
+// an error, so that a peer cannot crash the node.
+func (s *Server) handle(ctx context.Context, msg *Message) (resp *Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.metrics.add(&s.metrics.receiveErrors, 1)
+			s.logger.Error("panic handling a message", "error", r, "stack", string(debug.Stack()))
+			resp, err = nil, fmt.Errorf("error handling message: %v", r)
+		}
+	}()
+	msg, err = s.open(msg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = s.process(ctx, msg)
+	if err != nil {
+		s.metrics.add(&s.metrics.receiveErrors, 1)
+		return nil, err
 	}
+	return s.seal(resp)
+}
 
-	merge(s.metadata, newMetadata)
-	printMetadata(s.metadata)
+// seal encrypts the message, if the nodes share a keyring
+func (s *Server) seal(msg *Message) (*Message, error) {
+	if s.config.Keyring == nil {
+		return msg, nil
+	}
+	return s.config.Keyring.seal(msg)
+}
 
+// open decrypts the message, if the nodes share a keyring,
+// and rejects the messages that are not authenticated
+func (s *Server) open(msg *Message) (*Message, error) {
+	if s.config.Keyring == nil {
+		if msg.Sealed != nil {
+			err := fmt.Errorf("%w: sealed message without keyring", errRejected)
+			s.reject(err)
+			return nil, err
+		}
+		return msg, nil
+	}
+	result, err := s.config.Keyring.open(msg)
+	if err != nil {
+		s.reject(err)
+		return nil, err
+	}
+	return result, nil
 }
 
-// liveNodes returns a list of nodes that are alive
-// except the local node
-func (s *Server) liveNodes() []string {
-	var result []string
+// reject counts and logs a rejected message or connection
+func (s *Server) reject(err error) {
+	s.metrics.add(&s.metrics.rejected, 1)
+	s.logger.Warn("rejected message", "error", err)
+}
+
+// process processes a message received from another node, and returns the response
+func (s *Server) process(ctx context.Context, msg *Message) (*Message, error) {
+	switch msg.Type {
+	case MessageSyn, MessageAck2, MessagePing, MessagePingReq:
+	default:
+		return nil, fmt.Errorf("unexpected message type %q", msg.Type)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.receive(msg, s.now())
+	switch msg.Type {
+	case MessageSyn:
+		return s.ack(msg), nil
+	case MessageAck2:
+	case MessagePingReq:
+		// probe the target on behalf of the sender,
+		// without holding the lock while waiting for it
+		s.lock.Unlock()
+		err := s.ping(ctx, msg.Target)
+		s.lock.Lock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.newMessage(MessageAck), nil
+}
+
+// receive processes a message received from another node.
+// It must be called with the lock held.
+func (s *Server) receive(msg *Message, now time.Time) {
+	if msg.Metadata != nil {
+		if dropped := s.dropOversized(msg.Metadata); dropped > 0 {
+			s.metrics.add(&s.metrics.droppedKeys, dropped)
+			s.logger.Warn("dropped entries exceeding the state limits", "from", msg.From, "keys", dropped)
+		}
+		events := merge(s.metadata, msg.Metadata, now)
+		s.metrics.add(&s.metrics.mergedKeys, len(events))
+		if len(events) > 0 {
+			s.logger.Debug("merged keys", "from", msg.From, "keys", len(events))
+		}
+		s.publish(events...)
+		for node, state := range msg.Metadata {
+			if err := s.clock.Observe(state.maxVersion()); err != nil {
+				s.logger.Warn("ignored a version from the future", "from", msg.From, "node", node, "error", err)
+			}
+		}
+	}
+	s.applyUpdates(msg.Members, now)
+	s.observe(now)
+	s.updateRing()
+	s.elect()
+	if sender, ok := s.membership[msg.From]; ok && sender.Status != StatusAlive {
+		// the sender may not know that we consider it failed,
+		// spread the word again so that it can refute it
+		s.broadcasts.enqueue(sender.Member)
+	}
+}
+
+// observe tracks the nodes found in the metadata and feeds the
+// failure detectors with the heartbeats received since the last observation
+func (s *Server) observe(now time.Time) {
 	for nId, nState := range s.metadata {
 		if nId == s.id {
 			continue
 		}
-		if nAddr, ok := nState[keyAddress]; ok {
-			result = append(result, nAddr.Value)
+		if _, ok := s.membership[nId]; !ok {
+			member := Member{
+				ID:     nId,
+				Status: StatusAlive,
+			}
+			if nAddr, ok := nState[keyAddress]; ok {
+				member.Address = nAddr.Value
+			}
+			s.membership[nId] = &memberState{Member: member, since: now}
+		}
+		hb, hasHeartbeat := nState[keyHeartbeat]
+		d, ok := s.detectors[nId]
+		if !ok {
+			// first time we hear about this node, consider it alive
+			s.detectors[nId] = newPhiDetector(now)
+			if hasHeartbeat {
+				s.heartbeats[nId] = hb.Version
+			}
+			continue
+		}
+		if hasHeartbeat && hb.Version.After(s.heartbeats[nId]) {
+			s.heartbeats[nId] = hb.Version
+			d.heartbeat(now)
 		}
 	}
+}
+
+// liveNodes returns the sorted addresses of the nodes
+// that are neither dead nor left except the local node
+func (s *Server) liveNodes() []string {
+	var result []string
+	for _, member := range s.membership {
+		if member.Status == StatusDead || member.Status == StatusLeft || member.Address == "" {
+			continue
+		}
+		result = append(result, member.Address)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// members returns the known members of the cluster, sorted by id
+func (s *Server) members() []Member {
+	result := []Member{s.self()}
+	for _, member := range s.membership {
+		result = append(result, member.Member)
+	}
+	for i := range result {
+		result[i].Tags = tags(s.metadata[result[i].ID])
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
 	return result
 }
 
+// self returns the local node as a member
+func (s *Server) self() Member {
+	status := StatusAlive
+	if s.left {
+		status = StatusLeft
+	}
+	return Member{
+		ID:          s.id,
+		Address:     s.id,
+		Status:      status,
+		Incarnation: s.incarnation,
+	}
+}
+
+// state returns the state of the cluster
+func (s *Server) state() State {
+	return State{
+		Metadata: s.metadata,
+		Members:  s.members(),
+	}
+}
+
+// listen starts receiving messages on the given address,
+// and initializes the local node state
+func (s *Server) listen(addr string) error {
+	for name := range s.config.Tags {
+		if err := validateTag(name); err != nil {
+			return err
+		}
+	}
+	if w, ok := s.config.Tags[tagWeight]; ok {
+		if _, err := parseWeight(w); err != nil {
+			return err
+		}
+	}
+	if t, ok := s.transport.(rejectingTransport); ok {
+		t.onReject(s.reject)
+	}
+	if t, ok := s.transport.(countingTransport); ok {
+		t.onTraffic(s.metrics.traffic)
+	}
+	if t, ok := s.transport.(rateLimitedTransport); ok {
+		t.limitRate(s.allowPeer)
+	}
+	if t, ok := s.transport.(limitedTransport); ok {
+		t.limitSize(s.config.MaxMessageSize, s.oversized)
+	}
+	if err := s.transport.Listen(addr, s.handle); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.id = s.transport.Addr()
+	s.logger.setID(s.id)
+	s.clock = newHLC(s.id, s.now, s.config.MaxClockOffset)
+	if s.config.DataDir != "" {
+		if err := s.restore(); err != nil {
+			s.transport.Close()
+			return err
+		}
+	}
+	s.addLocalState(keyAddress, s.id)
+	s.setTags(s.config.Tags)
+	s.ringStale = true
+	s.updateRing()
+	s.elect()
+	return nil
+}
+
+// restore recovers the state persisted in the data directory. The clock
+// observes the recovered versions, so that the next local writes are newer
+// than the ones before the restart. It must be called with the lock held.
+func (s *Server) restore() error {
+	st, err := openStore(s.config.DataDir)
+	if err != nil {
+		return err
+	}
+	metadata, err := st.load()
+	if err != nil {
+		st.close()
+		return err
+	}
+	for node, state := range metadata {
+		if err := s.clock.Observe(state.maxVersion()); err != nil {
+			s.logger.Warn("ignored a persisted version from the future", "node", node, "error", err)
+		}
+	}
+	if hb, ok := metadata[s.id][keyHeartbeat]; ok {
+		s.heartbeat, _ = strconv.Atoi(hb.Value)
+	}
+	s.metadata = metadata
+	s.store = st
+	return nil
+}
+
+// closeStore snapshots the state and closes the data directory, if any
+func (s *Server) closeStore() {
+	s.snapshot()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.store == nil {
+		return
+	}
+	if err := s.store.close(); err != nil {
+		s.logger.Error("error closing wal", "error", err)
+	}
+	s.store = nil
+}
+
+// snapshot writes the state to the data directory, if any. The state
+// is encoded with the lock held, and written after releasing it.
+func (s *Server) snapshot() {
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+	s.lock.RLock()
+	st := s.store
+	if st == nil {
+		s.lock.RUnlock()
+		return
+	}
+	data, err := st.prepareSnapshot(s.metadata)
+	s.lock.RUnlock()
+	if err != nil {
+		s.logger.Error("error writing snapshot", "error", err)
+		return
+	}
+	if err := st.snapshot(data); err != nil {
+		s.logger.Error("error writing snapshot", "error", err)
+	}
+}
+
 // Start starts the gossip server
 func (s *Server) Start(ctx context.Context, addr string) error {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
+	if t, ok := s.transport.(apiTransport); ok && s.config.APIAddr == "" {
+		t.serveAPI(s)
+	}
+	if err := s.listen(addr); err != nil {
 		return err
 	}
-	s.listener = l
-	s.id = l.Addr().String()
-	s.addLocalState(keyAddress, s.id)
+	s.refreshSeeds(ctx)
+	var apiServer *http.Server
+	if s.config.APIAddr != "" {
+		l, err := net.Listen("tcp", s.config.APIAddr)
+		if err != nil {
+			s.transport.Close()
+			return err
+		}
+		apiServer = &http.Server{Handler: s}
+		go func() {
+			if err := apiServer.Serve(l); err != http.ErrServerClosed {
+				return
+			}
+		}()
+	}
 	go func() {
-		if err := http.Serve(l, s); err != http.ErrServerClosed {
-			return
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				s.doGossip(ctx)
+				// the writes of the round, such as a new leader
+				s.sync()
+				time.Sleep(s.config.Interval)
+			}
 		}
 	}()
 	go func() {
@@ -167,72 +791,175 @@ func (s *Server) Start(ctx context.Context, addr string) error {
 			case <-ctx.Done():
 				return
 			default:
-				s.doGossip()
-				time.Sleep(time.Second * 1)
+				s.probe(ctx)
+				time.Sleep(s.config.ProbeInterval)
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.config.SnapshotInterval):
+				s.snapshot()
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.config.SeedInterval):
+				s.refreshSeeds(ctx)
+				s.gossipSeed(ctx)
 			}
 		}
 	}()
 	<-ctx.Done()
-	if err := s.listener.Close(); err != nil {
-		return err
+	leaveCtx, cancel := s.withTimeout(context.Background(), s.config.Timeout)
+	s.Leave(leaveCtx)
+	cancel()
+	s.closeStore()
+	if apiServer != nil {
+		if err := apiServer.Close(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return s.transport.Close()
 }
 
 // ServeHTTP handles http requests
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, "invalid content type", http.StatusBadRequest)
+	if r.URL.Path == "/metrics" && r.Method == http.MethodGet {
+		s.writeMetrics(w)
 		return
 	}
-
-	if r.URL.Path == "/gossip" && r.Method == http.MethodPost {
-		var gossipRequest ClusterMetadata
-		if err := json.NewDecoder(r.Body).Decode(&gossipRequest); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	if r.Method != http.MethodGet {
+		// only the requests with a body need a content type, so that
+		// browsers and scrapers can get the state or watch the keys
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "invalid content type", http.StatusBadRequest)
 			return
 		}
-
-		s.lock.Lock()
-		defer s.lock.Unlock()
-		merge(s.metadata, gossipRequest)
-		printMetadata(s.metadata)
-
-		if err := json.NewEncoder(w).Encode(s.metadata); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		body, err := readLimited(r.Body, s.config.MaxMessageSize)
+		if errors.Is(err, errTooLarge) {
+			s.oversized(err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
 
-	} else if r.URL.Path == "/state" && r.Method == http.MethodGet {
+	if r.URL.Path == "/state" && r.Method == http.MethodGet {
 		s.lock.RLock()
 		defer s.lock.RUnlock()
-		if err := json.NewEncoder(w).Encode(s.metadata); err != nil {
+		// the metadata alone, as before the members were reported,
+		// unless they are asked for
+		var state interface{} = s.metadata
+		if r.URL.Query().Get("members") == "true" {
+			state = s.state()
+		}
+		if err := json.NewEncoder(w).Encode(state); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	} else if r.URL.Path == "/" && r.Method == http.MethodPost {
+		var ttl time.Duration
+		if q := r.URL.Query().Get("ttl"); q != "" {
+			var err error
+			if ttl, err = time.ParseDuration(q); err != nil || ttl <= 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl %q", q), http.StatusBadRequest)
+				return
+			}
+		}
 		var req map[string]string
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		s.lock.Lock()
-		defer s.lock.Unlock()
+		if err := s.checkWrite(req); err != nil {
+			s.lock.Unlock()
+			http.Error(w, err.Error(), writeErrorStatus(err))
+			return
+		}
 		for key, value := range req {
-			println("Setting key", key, "to", value)
-			s.addLocalState(key, value)
+			s.logger.Debug("setting key", "key", key, "value", value, "ttl", ttl)
+			s.addLocalStateTTL(key, value, ttl)
 		}
+		s.lock.Unlock()
+		s.sync()
+	} else if r.URL.Path == "/members" && r.Method == http.MethodGet {
+		selector, err := ParseSelector(r.URL.Query().Get("selector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(s.Members(selector)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if r.URL.Path == "/leader" && r.Method == http.MethodGet {
+		s.getLeader(w)
+	} else if r.URL.Path == "/watch" && r.Method == http.MethodGet {
+		s.watch(w, r)
+	} else if r.URL.Path == "/crdt" && r.Method == http.MethodGet {
+		s.getCRDT(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/crdt/") && r.Method == http.MethodPost {
+		s.updateCRDT(w, r, strings.TrimPrefix(r.URL.Path, "/crdt/"))
+	} else if r.URL.Path == "/" && r.Method == http.MethodDelete {
+		var keys []string
+		if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, key := range keys {
+			if err := checkKey(key); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		s.lock.Lock()
+		for _, key := range keys {
+			s.logger.Debug("deleting key", "key", key)
+			s.deleteLocalState(key)
+		}
+		s.lock.Unlock()
+		s.sync()
 	}
 
 }
 
-// printMetadata prints the node metadata
-func printMetadata(metadata ClusterMetadata) {
-	jsonBytes, _ := json.Marshal(metadata)
-	fmt.Println(string(jsonBytes))
+// writeErrorStatus returns the http status of an error of checkWrite
+func writeErrorStatus(err error) int {
+	if errors.Is(err, errTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// writeMetrics writes the metrics in the Prometheus text format
+func (s *Server) writeMetrics(w http.ResponseWriter) {
+	s.lock.RLock()
+	keys := 0
+	for _, state := range s.metadata {
+		keys += len(state)
+	}
+	members := make(map[NodeStatus]int)
+	for _, member := range s.members() {
+		members[member.Status]++
+	}
+	s.lock.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w, keys, members)
 }
 
 // Address returns the address of the server
 func (s *Server) Address() string {
-	return s.listener.Addr().String()
+	return s.transport.Addr()
 }
@@ -26,27 +26,220 @@ package gossip
 
 import (
 	"context"
+	"dsa/cmd/gossip/client"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
-func TestGossip(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// hasAliveMember returns true if the server sees the given node as alive
+func hasAliveMember(s *Server, id string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, member := range s.members() {
+		if member.ID == id && member.Status == StatusAlive {
+			return true
+		}
+	}
+	return false
+}
 
+// newTestServer returns a server that is not started, with the given id and physical clock
+func newTestServer(id string, physical func() time.Time) *Server {
+	s := NewServer([]string{}, DefaultConfig())
+	s.id = id
+	s.clock = newHLC(id, physical, s.config.MaxClockOffset)
+	return s
+}
+
+// startServer starts the server on a random port in the background, sending
+// the result of Start to errs, and returns its address once it listens
+func startServer(t *testing.T, ctx context.Context, s *Server, errs chan<- error) string {
 	go func() {
-		s1 := NewServer([]string{})
-		if err := s1.Start(ctx, "localhost:8080"); err != nil {
-			t.Fatal(err)
-		}
+		errs <- s.Start(ctx, "127.0.0.1:0")
 	}()
+	assert.Eventually(t, func() bool { return listening(s) }, 5*time.Second, 10*time.Millisecond)
+	return s.Address()
+}
 
-	go func() {
-		s2 := NewServer([]string{"localhost:8080"})
-		if err := s2.Start(ctx, "localhost:8081"); err != nil {
-			t.Fatal(err)
+// sees returns true if the node behind the client sees the given node as alive
+func sees(ctx context.Context, c *client.Client, id string) bool {
+	members, err := c.Members(ctx, "")
+	if err != nil {
+		return false
+	}
+	for _, member := range members {
+		if member.ID == id && member.Status == string(StatusAlive) {
+			return true
 		}
-	}()
+	}
+	return false
+}
+
+func TestGossip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultConfig()
+	config.Tags = map[string]string{"role": "db", "zone": "b"}
+	errs := make(chan error, 2)
+	addr1 := startServer(t, ctx, NewServer([]string{}, DefaultConfig()), errs)
+	addr2 := startServer(t, ctx, NewServer([]string{addr1}, config), errs)
+
+	c1 := client.New(addr1, client.Config{})
+	c2 := client.New(addr2, client.Config{})
+
+	assert.Eventually(t, func() bool {
+		return sees(ctx, c1, addr2) && sees(ctx, c2, addr1)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	members, err := c1.Members(ctx, "role=db,zone!=a")
+	assert.NoError(t, err)
+	assert.Equal(t, []client.Member{{
+		ID:      addr2,
+		Address: addr2,
+		Status:  "alive",
+		Tags:    map[string]string{"role": "db", "zone": "b"},
+	}}, members)
+
+	assert.NoError(t, c2.Set(ctx, map[string]string{"a": "b"}))
+
+	assert.Eventually(t, func() bool {
+		v, err := c1.Get(ctx, addr2, "a")
+		return err == nil && v.Value == "b"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	state, err := c1.State(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", state.Metadata[addr2]["a"].Value)
+	assert.Len(t, state.Members, 2)
+
+	assert.NoError(t, c2.Delete(ctx, "a"))
+
+	assert.Eventually(t, func() bool {
+		_, err := c1.Get(ctx, addr2, "a")
+		return errors.Is(err, client.ErrNotFound)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+
+}
+
+func TestStateShape(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.lock.Lock()
+	s.addLocalState("k", "v")
+	s.lock.Unlock()
+
+	// the metadata alone, keyed by node
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/state", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var metadata ClusterMetadata
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &metadata))
+	assert.Equal(t, "v", metadata["a"]["k"].Value)
+	assert.NotContains(t, metadata, "members")
+
+	// the metadata and the members
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/state?members=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var state State
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+	assert.Equal(t, "v", state.Metadata["a"]["k"].Value)
+	assert.Equal(t, []Member{{ID: "a", Address: "a", Status: StatusAlive}}, state.Members)
+}
+
+func TestAckModes(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.addLocalState("a", "a")
+	syn := &Message{
+		From:   "b",
+		Digest: Digest{"b": {Time: 1}},
+	}
+
+	tests := []struct {
+		name           string
+		mode           Mode
+		expectMetadata ClusterMetadata
+		expectDigest   Digest
+	}{
+		{
+			name: "push",
+			mode: ModePush,
+			expectDigest: Digest{
+				"b": {},
+			},
+		}, {
+			name: "pull",
+			mode: ModePull,
+			expectMetadata: ClusterMetadata{
+				"a": s.metadata["a"],
+			},
+		}, {
+			name: "push-pull",
+			mode: ModePushPull,
+			expectMetadata: ClusterMetadata{
+				"a": s.metadata["a"],
+			},
+			expectDigest: Digest{
+				"b": {},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syn.Mode = tt.mode
+			ack := s.ack(syn)
+			assert.Equal(t, tt.expectMetadata, ack.Metadata)
+			assert.Equal(t, tt.expectDigest, ack.Digest)
+		})
+	}
+}
+
+func TestLocalStateTTL(t *testing.T) {
+	now := time.Now()
+	s := newTestServer("a", func() time.Time {
+		return now
+	})
+	s.addLocalStateTTL("a", "a", time.Minute)
+	v := s.metadata["a"]["a"]
+	assert.Equal(t, v.Version.Time+time.Minute.Milliseconds(), v.Expires)
+
+	// refreshing the value postpones its expiry
+	now = now.Add(time.Second)
+	s.addLocalStateTTL("a", "a", time.Minute)
+	assert.Equal(t, now.UnixMilli()+time.Minute.Milliseconds(), v.Expires)
+
+	// a value without ttl does not expire
+	s.addLocalState("a", "a")
+	assert.Zero(t, v.Expires)
+	s.addLocalStateTTL("a", "a", time.Minute)
+
+	s.collectExpired(now.Add(time.Minute - time.Millisecond))
+	assert.Contains(t, s.metadata["a"], "a")
+	s.collectExpired(now.Add(time.Minute))
+	assert.NotContains(t, s.metadata["a"], "a")
+}
 
-	<-ctx.Done()
+func TestDeleteLocalState(t *testing.T) {
+	now := time.Now()
+	s := newTestServer("a", func() time.Time {
+		return now
+	})
+	s.addLocalState("a", "a")
+	s.addLocalState("b", "b")
+	s.deleteLocalState("b")
+	assert.Equal(t, &VersionedStr{Version: Version{Time: now.UnixMilli(), Counter: 2, Node: "a"}, Deleted: true}, s.metadata["a"]["b"])
 
+	// versions keep increasing after the tombstone is collected
+	collectTombstones(s.metadata, now.Add(time.Second))
+	s.addLocalState("b", "c")
+	assert.Equal(t, &VersionedStr{Version: Version{Time: now.UnixMilli(), Counter: 3, Node: "a"}, Value: "c"}, s.metadata["a"]["b"])
 }
@@ -0,0 +1,72 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"dsa/cmd/gossip/ring"
+	"fmt"
+	"strconv"
+)
+
+// tagWeight is the tag holding the weight of a node on the hashing ring
+const tagWeight = "weight"
+
+// parseWeight parses the weight tag of a node, between 1 and ring.MaxWeight
+func parseWeight(value string) (int, error) {
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 || weight > ring.MaxWeight {
+		return 0, fmt.Errorf("invalid weight %q, it must be an integer between 1 and %d", value, ring.MaxWeight)
+	}
+	return weight, nil
+}
+
+// updateRing places the live members on the hashing ring of the
+// configuration, if any, when the members or their tags changed.
+// It must be called with the lock held.
+func (s *Server) updateRing() {
+	if s.config.Ring == nil || s.id == "" || !s.ringStale {
+		return
+	}
+	s.ringStale = false
+	var nodes []ring.Node
+	for _, member := range s.members() {
+		if member.Status == StatusDead || member.Status == StatusLeft {
+			continue
+		}
+		weight := 1
+		if w, ok := member.Tags[tagWeight]; ok {
+			parsed, err := parseWeight(w)
+			if err != nil {
+				s.logger.Warn("ignoring the weight of a member", "member", member.ID, "error", err)
+			} else {
+				weight = parsed
+			}
+		}
+		nodes = append(nodes, ring.Node{ID: member.ID, Weight: weight})
+	}
+	if moved := s.config.Ring.Set(nodes...); len(moved) > 0 {
+		s.logger.Info("hashing ring changed", "nodes", len(nodes), "moved", len(moved))
+	}
+}
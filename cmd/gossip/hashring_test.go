@@ -0,0 +1,81 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"dsa/cmd/gossip/ring"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestUpdateRing(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.config.Ring = ring.New(ring.Config{})
+	changes, cancel := s.config.Ring.Subscribe()
+	defer cancel()
+	now := time.Now()
+	s.applyUpdate(Member{ID: "b", Address: "b", Status: StatusAlive}, now)
+	s.applyUpdate(Member{ID: "c", Address: "c", Status: StatusAlive}, now)
+	s.metadata["b"] = NodeState{keyTagPrefix + tagWeight: {Value: "2"}}
+	s.updateRing()
+	assert.Equal(t, []ring.Node{{ID: "a", Weight: 1}, {ID: "b", Weight: 2}, {ID: "c", Weight: 1}}, s.config.Ring.Nodes())
+	assert.Len(t, changes, 1)
+
+	// the owners of the keys of a dead node move to the others
+	s.applyUpdate(Member{ID: "c", Status: StatusDead, Incarnation: 1}, now)
+	s.updateRing()
+	assert.Equal(t, []ring.Node{{ID: "a", Weight: 1}, {ID: "b", Weight: 2}}, s.config.Ring.Nodes())
+	<-changes
+	change := <-changes
+	assert.NotEmpty(t, change.Moved)
+	for _, moved := range change.Moved {
+		assert.Contains(t, moved.Old, "c")
+		assert.NotContains(t, moved.New, "c")
+	}
+
+	// nothing changes
+	s.updateRing()
+	assert.Empty(t, changes)
+	s.receive(&Message{From: "b"}, now)
+	assert.False(t, s.ringStale)
+	assert.Empty(t, changes)
+
+	// a gossiped weight out of bounds is ignored
+	s.receive(&Message{From: "b", Metadata: ClusterMetadata{"b": NodeState{
+		keyTagPrefix + tagWeight: {Value: "1000000", Version: Version{Time: 1, Node: "b"}},
+	}}}, now)
+	assert.Equal(t, []ring.Node{{ID: "a", Weight: 1}, {ID: "b", Weight: 1}}, s.config.Ring.Nodes())
+}
+
+func TestParseWeight(t *testing.T) {
+	weight, err := parseWeight("3")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, weight)
+	for _, value := range []string{"", "a", "0", "-1", "101"} {
+		_, err := parseWeight(value)
+		assert.Error(t, err, value)
+	}
+}
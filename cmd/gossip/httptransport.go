@@ -0,0 +1,448 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compressThreshold is the size above which the messages are compressed
+const compressThreshold = 1024
+
+// jsonRetry is the time after which a node that only understood
+// uncompressed JSON is sent the configured codec again, as it may
+// have been upgraded
+const jsonRetry = 10 * time.Minute
+
+// legacyRefusal is the error of the older nodes that only understand JSON
+// for the messages of another content type. They answer it with a 400
+// status, instead of the 415 status of the current nodes.
+const legacyRefusal = "invalid content type"
+
+// httpPaths are the paths of the messages on the HTTP transport
+var httpPaths = map[MessageType]string{
+	MessageSyn:     "/gossip",
+	MessageAck2:    "/gossip/ack2",
+	MessagePing:    "/ping",
+	MessagePingReq: "/ping-req",
+}
+
+// HTTPTransport exchanges the messages over HTTP. Every message is a POST
+// request, and its response is the body of the HTTP response. The other
+// requests are passed to the HTTP API of the server.
+//
+// The codec of a message is given by its Content-Type, and the codec of the
+// response is negotiated with the Accept header. Nodes that only understand
+// uncompressed JSON reject the other messages, and are then sent JSON for a while.
+type HTTPTransport struct {
+	// Codec encodes the messages sent to the other nodes.
+	Codec Codec
+	// Compress compresses the large messages with gzip.
+	Compress bool
+	// client is the http client used to contact the other nodes.
+	client *http.Client
+	// handler handles the received messages.
+	handler Handler
+	// api handles the requests that are not messages.
+	api http.Handler
+	// listener is the listener of the transport.
+	listener net.Listener
+	// server is the http server of the transport.
+	server *http.Server
+	// tls is the TLS configuration of the transport, if any.
+	tls *tls.Config
+	// reject is called with the connections rejected during the TLS handshake.
+	reject func(error)
+	// traffic is called with the number of bytes sent and received.
+	traffic func(sent int, received int)
+	// maxSize is the maximum size of the received messages, once
+	// decompressed. The size is not limited if it is 0.
+	maxSize int
+	// oversized is called with the messages larger than maxSize.
+	oversized func(error)
+	// allow returns an error if the peer at the given address exceeds its rate limit.
+	allow func(peer string) error
+	// jsonOnly are the nodes that only understand uncompressed JSON,
+	// with the time they were found to.
+	jsonOnly map[string]time.Time
+	lock     sync.Mutex
+}
+
+// NewHTTPTransport creates a new HTTPTransport that sends
+// binary messages, compressed when they are large
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{
+		Codec:    BinaryCodec,
+		Compress: true,
+		client:   &http.Client{},
+		jsonOnly: make(map[string]time.Time),
+	}
+}
+
+// NewTLSTransport creates a new HTTPTransport that uses TLS with the given
+// configuration, both to serve and to contact the other nodes. With the
+// configuration of LoadMutualTLS, only the nodes holding a certificate
+// signed by the certificate authority can exchange messages.
+func NewTLSTransport(config *tls.Config) *HTTPTransport {
+	t := NewHTTPTransport()
+	t.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+	t.tls = config
+	return t
+}
+
+// onReject registers the function called with the rejected connections
+func (t *HTTPTransport) onReject(reject func(error)) {
+	t.reject = reject
+}
+
+// limitSize limits the size of the received messages, and registers
+// the function called with the messages exceeding it
+func (t *HTTPTransport) limitSize(max int, exceeded func(error)) {
+	t.maxSize = max
+	t.oversized = exceeded
+}
+
+// limitRate registers the function limiting the rate of the messages of the peers
+func (t *HTTPTransport) limitRate(allow func(peer string) error) {
+	t.allow = allow
+}
+
+// onTraffic registers the function called with the bytes sent and received
+func (t *HTTPTransport) onTraffic(count func(sent int, received int)) {
+	t.traffic = count
+}
+
+// count counts the bytes sent and received
+func (t *HTTPTransport) count(sent int, received int) {
+	if t.traffic != nil {
+		t.traffic(sent, received)
+	}
+}
+
+// errorLog receives the errors of the http server of a transport
+type errorLog struct {
+	transport *HTTPTransport
+}
+
+// Write reports the failed TLS handshakes as rejected connections
+func (l errorLog) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if strings.Contains(line, "TLS handshake error") && l.transport.reject != nil {
+		l.transport.reject(errors.New(line))
+	}
+	return len(p), nil
+}
+
+// serveAPI serves the given HTTP API next to the messages
+func (t *HTTPTransport) serveAPI(api http.Handler) {
+	t.api = api
+}
+
+// Listen starts receiving messages on the given address
+func (t *HTTPTransport) Listen(addr string, handler Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if t.tls != nil {
+		l = tls.NewListener(l, t.tls)
+	}
+	t.listener = l
+	t.handler = handler
+	t.server = &http.Server{
+		Handler:  t,
+		ErrorLog: log.New(errorLog{t}, "", 0),
+	}
+	go func() {
+		if err := t.server.Serve(l); err != http.ErrServerClosed {
+			return
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the transport listens on
+func (t *HTTPTransport) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Close stops the http server
+func (t *HTTPTransport) Close() error {
+	// close the open connections too, so that the node stops answering
+	return t.server.Close()
+}
+
+// Send sends a message to the node at the given address and returns its response
+func (t *HTTPTransport) Send(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	path, ok := httpPaths[msg.Type]
+	if !ok {
+		return nil, fmt.Errorf("cannot send message of type %q", msg.Type)
+	}
+	t.lock.Lock()
+	codec, compress := t.Codec, t.Compress
+	if since, ok := t.jsonOnly[addr]; ok {
+		if time.Since(since) < jsonRetry {
+			codec, compress = JSONCodec, false
+		} else {
+			delete(t.jsonOnly, addr)
+		}
+	}
+	t.lock.Unlock()
+
+	resp, fallback, err := t.post(ctx, addr, path, msg, codec, compress)
+	if fallback {
+		// the node does not understand the message, it may be
+		// an older node that only understands uncompressed JSON
+		resp, _, err = t.post(ctx, addr, path, msg, JSONCodec, false)
+		if err == nil {
+			t.lock.Lock()
+			t.jsonOnly[addr] = time.Now()
+			t.lock.Unlock()
+		}
+	}
+	return resp, err
+}
+
+// post sends the message encoded with the given codec, compressed if asked
+// and large enough, and returns its response. It also returns true if the
+// message was refused while it was not uncompressed JSON.
+func (t *HTTPTransport) post(ctx context.Context, addr string, path string, msg *Message, codec Codec, compress bool) (*Message, bool, error) {
+	body, err := codec.Encode(msg)
+	if err != nil {
+		return nil, false, err
+	}
+	compress = compress && len(body) >= compressThreshold
+	if compress {
+		if body, err = gzipBytes(body); err != nil {
+			return nil, false, err
+		}
+	}
+	scheme := "http"
+	if t.tls != nil {
+		scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s://%s%s", scheme, addr, path), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", codec.ContentType())
+	req.Header.Set("Accept", codec.ContentType())
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	// the http client asks for gzip responses and
+	// decompresses them, as Accept-Encoding is not set
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	t.count(len(body), len(respBytes))
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		refused := resp.StatusCode == http.StatusUnsupportedMediaType ||
+			resp.StatusCode == http.StatusBadRequest && strings.TrimSpace(string(respBytes)) == legacyRefusal
+		return nil, refused && (codec != JSONCodec || compress), fmt.Errorf("unexpected status %d: %s", resp.StatusCode, respBytes)
+	}
+
+	// older nodes always answer JSON, without content type
+	respCodec, ok := codecs[mediaType(resp.Header.Get("Content-Type"))]
+	if !ok {
+		respCodec = JSONCodec
+	}
+	var ack Message
+	if err := respCodec.Decode(respBytes, &ack); err != nil {
+		return nil, false, err
+	}
+	return &ack, false, nil
+}
+
+// ServeHTTP handles http requests
+func (t *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	msgType, ok := httpMessageType(r.URL.Path)
+	if !ok || r.Method != http.MethodPost {
+		if t.api == nil {
+			http.NotFound(w, r)
+			return
+		}
+		t.api.ServeHTTP(w, r)
+		return
+	}
+	if t.allow != nil {
+		if err := t.allow(peerHost(r.RemoteAddr)); err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+	codec, ok := codecs[mediaType(r.Header.Get("Content-Type"))]
+	if !ok {
+		http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	counter := &countingReader{r: r.Body}
+	defer func() {
+		t.count(0, counter.n)
+	}()
+	var body io.Reader = counter
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		http.Error(w, "invalid content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := readLimited(body, t.maxSize)
+	if errors.Is(err, errTooLarge) {
+		if t.oversized != nil {
+			t.oversized(err)
+		}
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg Message
+	if err := codec.Decode(data, &msg); errors.Is(err, errUnsupportedFormat) {
+		// a newer node falls back to JSON
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the path is authoritative, older nodes do not send the type
+	msg.Type = msgType
+
+	resp, err := t.handler(r.Context(), &msg)
+	if errors.Is(err, errRejected) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		// the other failing messages are the ping requests
+		// whose target did not answer
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	respCodec := acceptedCodec(r.Header.Get("Accept"))
+	respBytes, err := respCodec.Encode(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", respCodec.ContentType())
+	if len(respBytes) >= compressThreshold && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if respBytes, err = gzipBytes(respBytes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Write(respBytes)
+	t.count(len(respBytes), 0)
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// httpMessageType returns the type of the messages sent to the given path
+func httpMessageType(path string) (MessageType, bool) {
+	for msgType, p := range httpPaths {
+		if p == path {
+			return msgType, true
+		}
+	}
+	return "", false
+}
+
+// mediaType returns the media type of a Content-Type header, without its parameters
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// acceptedCodec returns the first known codec of an Accept header, or JSON
+func acceptedCodec(accept string) Codec {
+	for _, part := range strings.Split(accept, ",") {
+		if codec, ok := codecs[mediaType(strings.TrimSpace(part))]; ok {
+			return codec
+		}
+	}
+	return JSONCodec
+}
+
+// gzipBytes compresses the given bytes with gzip
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,282 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errTooLarge is the error of the messages, requests and writes
+	// that exceed the size limits of the node
+	errTooLarge = errors.New("too large")
+	// errRateLimited is the error of the messages of the
+	// nodes that exceed their rate limit
+	errRateLimited = errors.New("rate limited")
+	// errReservedKey is the error of the writes of the keys of the protocol
+	errReservedKey = errors.New("reserved key")
+)
+
+const (
+	// minPrune is the number of peers above which the
+	// rate limiter forgets the idle peers at once
+	minPrune = 1024
+	// pruneInterval is the time between two removals of the idle peers
+	pruneInterval = time.Minute
+)
+
+// readLimited reads the reader until its end, and returns
+// errTooLarge if it is longer than max bytes. A max of 0
+// reads the reader without limit.
+func readLimited(r io.Reader, max int) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, fmt.Errorf("%w: more than %d bytes", errTooLarge, max)
+	}
+	return data, nil
+}
+
+// tokenBucket is the token bucket of a peer
+type tokenBucket struct {
+	// tokens is the number of messages the peer can send right away.
+	tokens float64
+	// last is the time the tokens were last refilled.
+	last time.Time
+}
+
+// rateLimiter limits the rate of the messages of each peer with a
+// token bucket. A bucket refills at the rate, up to the burst, and
+// every message takes a token from the bucket of its sender. The peers
+// are identified by their network address, that they cannot forge
+// as easily as the sender of the messages.
+type rateLimiter struct {
+	// rate is the number of tokens added to a bucket every second.
+	rate float64
+	// burst is the capacity of a bucket.
+	burst float64
+	// buckets are the buckets of the peers.
+	buckets map[string]*tokenBucket
+	// pruneAt is the number of buckets above which the full ones are removed.
+	pruneAt int
+	// pruned is the time the full buckets were last removed.
+	pruned time.Time
+	lock   sync.Mutex
+}
+
+// newRateLimiter creates a rate limiter allowing the given rate
+// of messages per second to each peer, with the given burst
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		pruneAt: minPrune,
+	}
+}
+
+// allow takes a token from the bucket of the peer, and
+// returns false if the bucket is empty
+func (l *rateLimiter) allow(peer string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.buckets) >= l.pruneAt || now.Sub(l.pruned) >= pruneInterval {
+		l.prune(now)
+	}
+	b, ok := l.buckets[peer]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[peer] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens earned since the last refill to the bucket
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+}
+
+// prune removes the full buckets, so that the peers that are gone do not
+// use memory. A full bucket behaves like a new one, so nothing is lost.
+func (l *rateLimiter) prune(now time.Time) {
+	for peer, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, peer)
+		}
+	}
+	l.pruneAt = 2 * len(l.buckets)
+	if l.pruneAt < minPrune {
+		l.pruneAt = minPrune
+	}
+	l.pruned = now
+}
+
+// peerHost returns the host of a network address, which identifies the
+// peer in the rate limiter, since the port changes with every connection
+func peerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// rateLimitedTransport is implemented by the transports that limit
+// the rate of the messages of each peer, before reading them
+type rateLimitedTransport interface {
+	limitRate(allow func(peer string) error)
+}
+
+// allowPeer takes a token from the bucket of the peer at the given
+// network address, and returns errRateLimited if the bucket is empty
+func (s *Server) allowPeer(peer string) error {
+	if s.limiter.allow(peer, s.now()) {
+		return nil
+	}
+	s.metrics.add(&s.metrics.rateLimited, 1)
+	s.logger.Debug("rate limited message", "peer", peer)
+	return fmt.Errorf("%w: %s", errRateLimited, peer)
+}
+
+// limitedTransport is implemented by the transports that
+// limit the size of the messages they receive
+type limitedTransport interface {
+	limitSize(max int, exceeded func(error))
+}
+
+// oversized counts and logs a message or a request exceeding the maximum size
+func (s *Server) oversized(err error) {
+	s.metrics.add(&s.metrics.oversized, 1)
+	s.logger.Warn("message too large", "error", err)
+}
+
+// checkKey returns an error if the key is reserved for the protocol
+func checkKey(key string) error {
+	if strings.HasPrefix(key, keyReservedPrefix) {
+		return fmt.Errorf("%w: %s starts with %s", errReservedKey, key, keyReservedPrefix)
+	}
+	return nil
+}
+
+// checkWrite returns an error if the given values would write a reserved
+// key, or exceed the maximum value length or the maximum number of keys of
+// the local node state. It must be called with the lock held.
+func (s *Server) checkWrite(values map[string]string) error {
+	keys := len(s.metadata[s.id])
+	for key, value := range values {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+		if len(value) > s.config.MaxValueLength {
+			return fmt.Errorf("%w: value of %s is longer than %d bytes", errTooLarge, key, s.config.MaxValueLength)
+		}
+		if _, ok := s.metadata[s.id][key]; !ok {
+			keys++
+		}
+	}
+	if keys > s.config.MaxKeys {
+		return fmt.Errorf("%w: more than %d keys", errTooLarge, s.config.MaxKeys)
+	}
+	return nil
+}
+
+// valueSize returns the size of a value, the size of
+// the JSON encoding of its CRDT if it holds one
+func valueSize(v *VersionedStr) int {
+	if v.CRDT != nil {
+		return crdtSize(v.CRDT)
+	}
+	return len(v.Value)
+}
+
+// crdtSize returns the size of the JSON encoding of a CRDT
+func crdtSize(crdt CRDT) int {
+	data, err := json.Marshal(crdt)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// dropOversized removes from the received metadata the null values, the
+// values longer than the maximum value length, and the new keys of the nodes
+// that would exceed the maximum number of keys, and returns the number of
+// removed entries.
+// The keys of the protocol are kept first. It must be called with the lock held.
+func (s *Server) dropOversized(metadata ClusterMetadata) int {
+	dropped := 0
+	for nodeId, state := range metadata {
+		keys := make([]string, 0, len(state))
+		for key := range state {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			pi, pj := strings.HasPrefix(keys[i], keyReservedPrefix), strings.HasPrefix(keys[j], keyReservedPrefix)
+			if pi != pj {
+				return pi
+			}
+			return keys[i] < keys[j]
+		})
+		count := len(s.metadata[nodeId])
+		for _, key := range keys {
+			_, known := s.metadata[nodeId][key]
+			if state[key] == nil || valueSize(state[key]) > s.config.MaxValueLength || (!known && count >= s.config.MaxKeys) {
+				delete(state, key)
+				dropped++
+				continue
+			}
+			if !known {
+				count++
+			}
+		}
+	}
+	return dropped
+}
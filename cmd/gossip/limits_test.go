@@ -0,0 +1,215 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLimited(t *testing.T) {
+	data, err := readLimited(strings.NewReader("abc"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(data))
+
+	_, err = readLimited(strings.NewReader("abcd"), 3)
+	assert.ErrorIs(t, err, errTooLarge)
+
+	data, err = readLimited(strings.NewReader("abcd"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(data))
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, 2)
+	assert.True(t, l.allow("a", now))
+	assert.True(t, l.allow("a", now))
+	assert.False(t, l.allow("a", now))
+	assert.True(t, l.allow("b", now))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow("a", now))
+	assert.False(t, l.allow("a", now))
+
+	// the peers whose bucket refilled are forgotten
+	for i := 0; i < minPrune; i++ {
+		l.allow(fmt.Sprint("peer", i), now)
+	}
+	assert.NotEmpty(t, l.buckets)
+	l.prune(now.Add(time.Second))
+	assert.Empty(t, l.buckets)
+}
+
+func TestStateLimits(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.config.MaxKeys = 3
+	s.config.MaxValueLength = 4
+	s.addLocalState("a", "a")
+
+	assert.NoError(t, s.checkWrite(map[string]string{"a": "aaaa", "b": "b", "c": "c"}))
+	assert.ErrorIs(t, s.checkWrite(map[string]string{"a": "aaaaa"}), errTooLarge)
+	assert.ErrorIs(t, s.checkWrite(map[string]string{"b": "b", "c": "c", "d": "d"}), errTooLarge)
+
+	s.metadata["b"] = NodeState{"b": {Value: "b"}}
+	received := ClusterMetadata{
+		"b": {
+			"a":                {Value: "a"},
+			"b":                {Value: "bbbbb"},
+			"c":                {Value: "c"},
+			"d":                {Value: "d"},
+			keyHeartbeat:       {Value: "1"},
+			"gossip_something": {Value: "1"},
+		},
+	}
+	assert.Equal(t, 4, s.dropOversized(received))
+	assert.Equal(t, ClusterMetadata{"b": {keyHeartbeat: {Value: "1"}, "gossip_something": {Value: "1"}}}, received)
+}
+
+func TestNullValues(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.receive(&Message{From: "b", Metadata: ClusterMetadata{
+		"b": {"a": nil, "b": {Value: "b", Version: Version{Time: 1, Node: "b"}}},
+		"c": nil,
+	}}, time.Now())
+	assert.Equal(t, NodeState{"b": {Value: "b", Version: Version{Time: 1, Node: "b"}}}, s.metadata["b"])
+	assert.Equal(t, uint64(1), s.metrics.get(&s.metrics.droppedKeys))
+}
+
+func TestCRDTLimits(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.config.MaxValueLength = 200
+
+	// the tags of the adds and removes make the set grow
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		if err = s.addElement("set", "e"); err == nil {
+			err = s.removeElement("set", "e")
+		}
+	}
+	assert.ErrorIs(t, err, errTooLarge)
+	assert.LessOrEqual(t, valueSize(s.metadata["a"]["set"]), 200)
+
+	received := ClusterMetadata{"b": {"set": {CRDT: ORSet{Adds: map[string][]string{"e": {strings.Repeat("t", 200)}}}}}}
+	assert.Equal(t, 1, s.dropOversized(received))
+}
+
+func TestServerLimits(t *testing.T) {
+	ctx := context.Background()
+	config := Config{MaxMessageSize: 2048, RateLimit: 1, RateBurst: 2, MaxValueLength: 16}
+	s1 := NewServer([]string{}, config)
+	s2 := NewServer([]string{}, DefaultConfig())
+	assert.NoError(t, s1.listen("127.0.0.1:0"))
+	defer s1.transport.Close()
+	assert.NoError(t, s2.listen("127.0.0.1:0"))
+	defer s2.transport.Close()
+
+	// the messages of s3 are too large
+	s3 := NewServer([]string{}, DefaultConfig())
+	assert.NoError(t, s3.listen("127.0.0.1:0"))
+	defer s3.transport.Close()
+	s3.lock.Lock()
+	s3.addLocalState("large", strings.Repeat("a", 4096))
+	syn := s3.newMessage(MessageAck2)
+	syn.Metadata = deltaSince(s3.metadata, Digest{})
+	s3.lock.Unlock()
+	_, err := s3.send(ctx, s1.Address(), syn)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "413")
+	}
+	assert.Equal(t, uint64(1), s1.metrics.get(&s1.metrics.oversized))
+
+	// the nodes share the bucket of their address, whatever sender
+	// they claim, and the rate limit is exceeded by the third message
+	assert.NoError(t, s2.ping(ctx, s1.Address()))
+	s2.lock.Lock()
+	ping := s2.newMessage(MessagePing)
+	s2.lock.Unlock()
+	ping.From = "forged"
+	_, err = s2.send(ctx, s1.Address(), ping)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "429")
+	}
+	assert.Equal(t, uint64(1), s1.metrics.get(&s1.metrics.rateLimited))
+
+	// the values written through the API are limited too
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"a":"`+strings.Repeat("a", 17)+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	s1.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"a":"`+strings.Repeat("a", 4096)+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	s1.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, uint64(2), s1.metrics.get(&s1.metrics.oversized))
+}
+
+func TestReservedKeys(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.lock.Lock()
+	s.addLocalState(keyAddress, "a")
+	s.lock.Unlock()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		expect int
+	}{
+		{name: "set", method: http.MethodPost, path: "/", body: `{"gossip_address":"b"}`, expect: http.StatusBadRequest},
+		{name: "set among other keys", method: http.MethodPost, path: "/", body: `{"a":"a","gossip_heartbeat":"1"}`, expect: http.StatusBadRequest},
+		{name: "delete", method: http.MethodDelete, path: "/", body: `["a","gossip_address"]`, expect: http.StatusBadRequest},
+		{name: "crdt", method: http.MethodPost, path: "/crdt/increment", body: `{"key":"gossip_leader","type":"g-counter","delta":1}`, expect: http.StatusBadRequest},
+		{name: "user key", method: http.MethodPost, path: "/", body: `{"my_gossip_key":"b"}`, expect: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			s.ServeHTTP(w, r)
+			assert.Equal(t, tt.expect, w.Code)
+		})
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	assert.Equal(t, "a", s.metadata["a"][keyAddress].Value)
+	assert.False(t, s.metadata["a"][keyAddress].Deleted)
+	assert.NotContains(t, s.metadata["a"], "a")
+	assert.NotContains(t, s.metadata["a"], keyHeartbeat)
+	assert.NotContains(t, s.metadata["a"], keyLeader)
+	assert.Contains(t, s.metadata["a"], "my_gossip_key")
+}
@@ -0,0 +1,233 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger is the leveled, structured logger of a gossip server. The args
+// are alternating keys and values. A *slog.Logger satisfies it, and
+// NewLogger returns an implementation for the older versions of Go.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Level is the severity of a log record. The levels match the ones of slog.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+// String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// ParseLevel parses a log level, one of debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+}
+
+// writerLogger writes the records at or above its level to a writer,
+// one per line, as text or as JSON
+type writerLogger struct {
+	w     io.Writer
+	level Level
+	json  bool
+	lock  sync.Mutex
+}
+
+// NewLogger returns a logger that writes the records at or above the given
+// level to the writer, in the given format, text or json
+func NewLogger(w io.Writer, level Level, format string) (Logger, error) {
+	switch format {
+	case "text":
+		return &writerLogger{w: w, level: level}, nil
+	case "json":
+		return &writerLogger{w: w, level: level, json: true}, nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+func (l *writerLogger) Debug(msg string, args ...interface{}) {
+	l.log(LevelDebug, msg, args)
+}
+
+func (l *writerLogger) Info(msg string, args ...interface{}) {
+	l.log(LevelInfo, msg, args)
+}
+
+func (l *writerLogger) Warn(msg string, args ...interface{}) {
+	l.log(LevelWarn, msg, args)
+}
+
+func (l *writerLogger) Error(msg string, args ...interface{}) {
+	l.log(LevelError, msg, args)
+}
+
+// log writes a record if its level is enabled
+func (l *writerLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	var b strings.Builder
+	if l.json {
+		record := map[string]interface{}{
+			"time":  now,
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for i := 0; i < len(args); i += 2 {
+			key, value := logAttr(args, i)
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			record[key] = value
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			data, _ = json.Marshal(map[string]interface{}{"time": now, "level": level.String(), "msg": msg, "error": err.Error()})
+		}
+		b.Write(data)
+	} else {
+		fmt.Fprintf(&b, "time=%s level=%s msg=%s", now.Format(time.RFC3339Nano), level, quoteIfNeeded(msg))
+		for i := 0; i < len(args); i += 2 {
+			key, value := logAttr(args, i)
+			fmt.Fprintf(&b, " %s=%s", key, quoteIfNeeded(fmt.Sprint(value)))
+		}
+	}
+	b.WriteByte('\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+// logAttr returns the key and the value of the attribute at index i of the args
+func logAttr(args []interface{}, i int) (string, interface{}) {
+	if i+1 == len(args) {
+		return "!BADKEY", args[i]
+	}
+	return fmt.Sprint(args[i]), args[i+1]
+}
+
+// quoteIfNeeded quotes the strings with spaces, quotes or equal signs
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// nopLogger discards the records
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// nodeLogger adds the id of the node to the records of a logger. The id
+// is only known once the node listens, and may be read concurrently.
+type nodeLogger struct {
+	logger Logger
+	id     atomic.Value
+}
+
+// newNodeLogger returns a nodeLogger of the given logger, or of a
+// logger that discards the records if it is nil
+func newNodeLogger(logger Logger) *nodeLogger {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	l := &nodeLogger{logger: logger}
+	l.id.Store("")
+	return l
+}
+
+// setID sets the id of the node
+func (l *nodeLogger) setID(id string) {
+	l.id.Store(id)
+}
+
+// args prepends the id of the node to the given args
+func (l *nodeLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{"node", l.id.Load()}, args...)
+}
+
+func (l *nodeLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Debug(msg, l.args(args)...)
+}
+
+func (l *nodeLogger) Info(msg string, args ...interface{}) {
+	l.logger.Info(msg, l.args(args)...)
+}
+
+func (l *nodeLogger) Warn(msg string, args ...interface{}) {
+	l.logger.Warn(msg, l.args(args)...)
+}
+
+func (l *nodeLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(msg, l.args(args)...)
+}
@@ -0,0 +1,130 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MemoryNetwork connects in-memory transports, so that many
+// nodes can run in the same process without opening ports.
+type MemoryNetwork struct {
+	// handlers are the handlers of the listening transports, by address.
+	handlers map[string]Handler
+	// next is the number of the next generated address.
+	next int
+	lock sync.RWMutex
+}
+
+// NewMemoryNetwork creates a new MemoryNetwork
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Transport returns a new transport attached to the network
+func (n *MemoryNetwork) Transport() *MemoryTransport {
+	return &MemoryTransport{network: n}
+}
+
+// MemoryTransport is a transport of a MemoryNetwork. The messages are
+// copied through their JSON encoding, so that the nodes share no memory.
+type MemoryTransport struct {
+	// network is the network of the transport.
+	network *MemoryNetwork
+	// addr is the address the transport listens on.
+	addr string
+}
+
+// Listen starts receiving messages on the given address.
+// An address is generated if the given one is empty.
+func (t *MemoryTransport) Listen(addr string, handler Handler) error {
+	n := t.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if addr == "" {
+		n.next++
+		addr = fmt.Sprintf("memory-%d", n.next)
+	}
+	if _, ok := n.handlers[addr]; ok {
+		return fmt.Errorf("address %s already in use", addr)
+	}
+	n.handlers[addr] = handler
+	t.addr = addr
+	return nil
+}
+
+// Addr returns the address the transport listens on
+func (t *MemoryTransport) Addr() string {
+	return t.addr
+}
+
+// Close detaches the transport from the network
+func (t *MemoryTransport) Close() error {
+	n := t.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.handlers, t.addr)
+	return nil
+}
+
+// Send sends a message to the node at the given address and returns its response
+func (t *MemoryTransport) Send(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t.network.lock.RLock()
+	handler, ok := t.network.handlers[addr]
+	t.network.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no node listening on %s", addr)
+	}
+	req, err := copyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return copyMessage(resp)
+}
+
+// copyMessage returns a deep copy of the message
+func copyMessage(msg *Message) (*Message, error) {
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var result Message
+	if err := json.Unmarshal(jsonBytes, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,63 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+// MessageType is the type of a message exchanged between gossip nodes.
+type MessageType string
+
+const (
+	// MessageSyn starts a gossip round with the digest of the sender.
+	MessageSyn MessageType = "syn"
+	// MessageAck is the response to any other message.
+	MessageAck MessageType = "ack"
+	// MessageAck2 ends a gossip round with the entries the receiver asked for.
+	MessageAck2 MessageType = "ack2"
+	// MessagePing is a direct SWIM probe.
+	MessagePing MessageType = "ping"
+	// MessagePingReq asks the receiver to probe the target on behalf of the sender.
+	MessagePingReq MessageType = "ping-req"
+)
+
+// Message is a message exchanged between gossip nodes.
+type Message struct {
+	// Type is the type of the message.
+	Type MessageType `json:"type,omitempty"`
+	// From is the id of the sender.
+	From string `json:"from"`
+	// Metadata are the cluster metadata entries sent to the receiver.
+	Metadata ClusterMetadata `json:"metadata,omitempty"`
+	// Digest is the digest of the cluster metadata of the sender for a
+	// SYN, or the digest of the entries the sender is missing for an ACK.
+	Digest Digest `json:"digest,omitempty"`
+	// Members are the membership updates piggybacked on the message.
+	Members []Member `json:"members,omitempty"`
+	// Mode is the gossip mode of the sender, for a SYN.
+	Mode Mode `json:"mode,omitempty"`
+	// Target is the address of the node to probe, for ping requests.
+	Target string `json:"target,omitempty"`
+	// Sealed is the encrypted message, when the nodes share a Keyring.
+	// The other fields are then empty, except the type.
+	Sealed []byte `json:"sealed,omitempty"`
+}
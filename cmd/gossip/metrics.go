@@ -0,0 +1,146 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// roundBuckets are the upper bounds of the buckets of the round duration
+// histogram, in seconds
+var roundBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics are the counters of a gossip server
+type metrics struct {
+	// rounds is the number of gossip rounds.
+	rounds uint64
+	// sendErrors is the number of messages that could not be sent.
+	sendErrors uint64
+	// receiveErrors is the number of received messages that could not be handled.
+	receiveErrors uint64
+	// rejected is the number of rejected messages and connections.
+	rejected uint64
+	// bytesSent is the number of bytes sent to the other nodes.
+	bytesSent uint64
+	// bytesReceived is the number of bytes received from the other nodes.
+	bytesReceived uint64
+	// mergedKeys is the number of keys changed by the received messages.
+	mergedKeys uint64
+	// oversized is the number of messages and requests exceeding the maximum size.
+	oversized uint64
+	// rateLimited is the number of messages refused by the rate limits.
+	rateLimited uint64
+	// droppedKeys is the number of received entries exceeding the state limits.
+	droppedKeys uint64
+	// roundCounts are the number of rounds of each bucket of roundBuckets,
+	// plus the rounds longer than the last bucket.
+	roundCounts []uint64
+	// roundSum is the total duration of the rounds.
+	roundSum time.Duration
+	lock     sync.Mutex
+}
+
+// newMetrics creates new metrics
+func newMetrics() *metrics {
+	return &metrics{
+		roundCounts: make([]uint64, len(roundBuckets)+1),
+	}
+}
+
+// add adds n to the given counter
+func (m *metrics) add(counter *uint64, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	*counter += uint64(n)
+}
+
+// get returns the value of the given counter
+func (m *metrics) get(counter *uint64) uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return *counter
+}
+
+// traffic counts the bytes exchanged with the other nodes
+func (m *metrics) traffic(sent int, received int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bytesSent += uint64(sent)
+	m.bytesReceived += uint64(received)
+}
+
+// round records a gossip round of the given duration
+func (m *metrics) round(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rounds++
+	m.roundSum += d
+	i := sort.SearchFloat64s(roundBuckets, d.Seconds())
+	m.roundCounts[i]++
+}
+
+// write writes the metrics in the Prometheus text format, with the
+// gauges of the number of keys and of the members by status
+func (m *metrics) write(w io.Writer, keys int, members map[NodeStatus]int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counter := func(name string, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("gossip_rounds_total", "Number of gossip rounds.", m.rounds)
+	counter("gossip_send_errors_total", "Number of messages that could not be sent.", m.sendErrors)
+	counter("gossip_receive_errors_total", "Number of received messages that could not be handled.", m.receiveErrors)
+	counter("gossip_rejected_total", "Number of rejected messages and connections.", m.rejected)
+	counter("gossip_sent_bytes_total", "Number of bytes sent to the other nodes.", m.bytesSent)
+	counter("gossip_received_bytes_total", "Number of bytes received from the other nodes.", m.bytesReceived)
+	counter("gossip_merged_keys_total", "Number of keys changed by the received messages.", m.mergedKeys)
+	counter("gossip_oversized_total", "Number of messages and requests exceeding the maximum size.", m.oversized)
+	counter("gossip_rate_limited_total", "Number of messages refused by the rate limits.", m.rateLimited)
+	counter("gossip_dropped_keys_total", "Number of received entries exceeding the state limits.", m.droppedKeys)
+
+	fmt.Fprintf(w, "# HELP gossip_keys Number of keys of the cluster metadata, tombstones included.\n# TYPE gossip_keys gauge\ngossip_keys %d\n", keys)
+
+	fmt.Fprintf(w, "# HELP gossip_members Number of members of the cluster by status.\n# TYPE gossip_members gauge\n")
+	for _, status := range []NodeStatus{StatusAlive, StatusSuspect, StatusDead, StatusLeft} {
+		fmt.Fprintf(w, "gossip_members{status=%q} %d\n", status, members[status])
+	}
+
+	name := "gossip_round_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of the gossip rounds.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, bound := range roundBuckets {
+		cumulative += m.roundCounts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += m.roundCounts[len(roundBuckets)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(m.roundSum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, m.rounds)
+}
@@ -0,0 +1,132 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.add(&m.sendErrors, 2)
+	m.add(&m.mergedKeys, 5)
+	m.traffic(100, 200)
+	m.round(3 * time.Millisecond)
+	m.round(time.Second)
+	m.round(time.Minute)
+
+	var b strings.Builder
+	m.write(&b, 7, map[NodeStatus]int{StatusAlive: 2, StatusDead: 1})
+	assert.Equal(t, `# HELP gossip_rounds_total Number of gossip rounds.
+# TYPE gossip_rounds_total counter
+gossip_rounds_total 3
+# HELP gossip_send_errors_total Number of messages that could not be sent.
+# TYPE gossip_send_errors_total counter
+gossip_send_errors_total 2
+# HELP gossip_receive_errors_total Number of received messages that could not be handled.
+# TYPE gossip_receive_errors_total counter
+gossip_receive_errors_total 0
+# HELP gossip_rejected_total Number of rejected messages and connections.
+# TYPE gossip_rejected_total counter
+gossip_rejected_total 0
+# HELP gossip_sent_bytes_total Number of bytes sent to the other nodes.
+# TYPE gossip_sent_bytes_total counter
+gossip_sent_bytes_total 100
+# HELP gossip_received_bytes_total Number of bytes received from the other nodes.
+# TYPE gossip_received_bytes_total counter
+gossip_received_bytes_total 200
+# HELP gossip_merged_keys_total Number of keys changed by the received messages.
+# TYPE gossip_merged_keys_total counter
+gossip_merged_keys_total 5
+# HELP gossip_oversized_total Number of messages and requests exceeding the maximum size.
+# TYPE gossip_oversized_total counter
+gossip_oversized_total 0
+# HELP gossip_rate_limited_total Number of messages refused by the rate limits.
+# TYPE gossip_rate_limited_total counter
+gossip_rate_limited_total 0
+# HELP gossip_dropped_keys_total Number of received entries exceeding the state limits.
+# TYPE gossip_dropped_keys_total counter
+gossip_dropped_keys_total 0
+# HELP gossip_keys Number of keys of the cluster metadata, tombstones included.
+# TYPE gossip_keys gauge
+gossip_keys 7
+# HELP gossip_members Number of members of the cluster by status.
+# TYPE gossip_members gauge
+gossip_members{status="alive"} 2
+gossip_members{status="suspect"} 0
+gossip_members{status="dead"} 1
+gossip_members{status="left"} 0
+# HELP gossip_round_duration_seconds Duration of the gossip rounds.
+# TYPE gossip_round_duration_seconds histogram
+gossip_round_duration_seconds_bucket{le="0.005"} 1
+gossip_round_duration_seconds_bucket{le="0.01"} 1
+gossip_round_duration_seconds_bucket{le="0.025"} 1
+gossip_round_duration_seconds_bucket{le="0.05"} 1
+gossip_round_duration_seconds_bucket{le="0.1"} 1
+gossip_round_duration_seconds_bucket{le="0.25"} 1
+gossip_round_duration_seconds_bucket{le="0.5"} 1
+gossip_round_duration_seconds_bucket{le="1"} 2
+gossip_round_duration_seconds_bucket{le="2.5"} 2
+gossip_round_duration_seconds_bucket{le="5"} 2
+gossip_round_duration_seconds_bucket{le="10"} 2
+gossip_round_duration_seconds_bucket{le="+Inf"} 3
+gossip_round_duration_seconds_sum 61.003
+gossip_round_duration_seconds_count 3
+`, b.String())
+}
+
+func TestServerMetrics(t *testing.T) {
+	ctx := context.Background()
+	s1 := NewServer([]string{}, DefaultConfig())
+	s2 := NewServer([]string{}, DefaultConfig())
+	assert.NoError(t, s1.listen("127.0.0.1:0"))
+	defer s1.transport.Close()
+	assert.NoError(t, s2.listen("127.0.0.1:0"))
+	defer s2.transport.Close()
+	s2.seedNodes = []string{s1.Address()}
+	s2.doGossip(ctx)
+
+	// scrapers do not send a content type
+	w := httptest.NewRecorder()
+	s1.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, "gossip_members{status=\"alive\"} 2\n")
+	assert.Contains(t, body, "gossip_keys 3\n")
+	assert.NotContains(t, body, "gossip_received_bytes_total 0\n")
+	assert.NotContains(t, body, "gossip_sent_bytes_total 0\n")
+	assert.NotContains(t, body, "gossip_merged_keys_total 0\n")
+
+	w = httptest.NewRecorder()
+	s2.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), "gossip_rounds_total 1\n")
+	assert.Contains(t, w.Body.String(), "gossip_round_duration_seconds_count 1\n")
+}
@@ -0,0 +1,443 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxFrameSize is the maximum size of a TCP frame.
+	maxFrameSize = 32 << 20
+	// maxDatagramSize is the maximum size of a UDP datagram.
+	maxDatagramSize = 65507
+	// udpWorkers is the maximum number of datagrams handled at once.
+	udpWorkers = 64
+	// connTimeout is the time a peer has to send
+	// its message once connected.
+	connTimeout = 10 * time.Second
+)
+
+// envelope is the frame of the raw transports,
+// carrying either a message or an error
+type envelope struct {
+	Message *Message `json:"message,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// open returns the message of the envelope, or its error
+func (e *envelope) open() (*Message, error) {
+	if e.Error != "" {
+		return nil, errors.New(e.Error)
+	}
+	if e.Message == nil {
+		return nil, errors.New("empty envelope")
+	}
+	return e.Message, nil
+}
+
+// trafficCounter counts the bytes exchanged by a raw transport,
+// and limits the rate of the messages of its peers
+type trafficCounter struct {
+	// traffic is called with the number of bytes sent and received.
+	traffic func(sent int, received int)
+	// allow returns an error if the peer at the given address exceeds its rate limit.
+	allow func(peer string) error
+}
+
+// onTraffic registers the function called with the bytes sent and received
+func (c *trafficCounter) onTraffic(count func(sent int, received int)) {
+	c.traffic = count
+}
+
+// limitRate registers the function limiting the rate of the messages of the peers
+func (c *trafficCounter) limitRate(allow func(peer string) error) {
+	c.allow = allow
+}
+
+// allowed returns an error if the peer at the given address exceeds its rate limit
+func (c *trafficCounter) allowed(addr net.Addr) error {
+	if c.allow == nil {
+		return nil
+	}
+	return c.allow(peerHost(addr.String()))
+}
+
+// count counts the bytes sent and received
+func (c *trafficCounter) count(sent int, received int) {
+	if c.traffic != nil {
+		c.traffic(sent, received)
+	}
+}
+
+// handleEnvelope passes the message of the envelope to the handler, and
+// returns the envelope of its response. A panic of the handler is answered
+// with an error, unlike net/http nothing would recover it otherwise.
+func handleEnvelope(ctx context.Context, handler Handler, req *envelope) (result *envelope) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = &envelope{Error: fmt.Sprintf("error handling message: %v", r)}
+		}
+	}()
+	if req.Message == nil {
+		return &envelope{Error: "empty envelope"}
+	}
+	resp, err := handler(ctx, req.Message)
+	if err != nil {
+		return &envelope{Error: err.Error()}
+	}
+	return &envelope{Message: resp}
+}
+
+// closeOnDone closes the connection when the context is done,
+// until the returned function is called
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// TCPTransport exchanges the messages over raw TCP connections. Every
+// message is sent on a new connection as a length-prefixed JSON frame,
+// and the response is read back from the same connection.
+type TCPTransport struct {
+	trafficCounter
+	// dialer is the dialer used to contact the other nodes.
+	dialer net.Dialer
+	// listener is the listener of the transport.
+	listener net.Listener
+	// ctx is cancelled when the transport is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wg tracks the open connections.
+	wg sync.WaitGroup
+	// maxSize is the maximum size of the received frames, if lower than maxFrameSize.
+	maxSize int
+	// oversized is called with the frames larger than maxSize.
+	oversized func(error)
+}
+
+// NewTCPTransport creates a new TCPTransport
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{}
+}
+
+// Listen starts receiving messages on the given address
+func (t *TCPTransport) Listen(addr string, handler Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	t.listener = l
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				t.serve(conn, handler)
+			}()
+		}
+	}()
+	return nil
+}
+
+// limitSize limits the size of the received frames, and registers
+// the function called with the frames exceeding it
+func (t *TCPTransport) limitSize(max int, exceeded func(error)) {
+	t.maxSize = max
+	t.oversized = exceeded
+}
+
+// serve answers the message received on the given connection
+func (t *TCPTransport) serve(conn net.Conn, handler Handler) {
+	defer conn.Close()
+	stop := closeOnDone(t.ctx, conn)
+	defer stop()
+	if err := t.allowed(conn.RemoteAddr()); err != nil {
+		n, _ := writeFrame(conn, &envelope{Error: err.Error()})
+		t.count(n, 0)
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(connTimeout))
+	max := maxFrameSize
+	if t.maxSize > 0 && t.maxSize < max {
+		max = t.maxSize
+	}
+	var req envelope
+	n, err := readFrame(conn, &req, max)
+	t.count(0, n)
+	if errors.Is(err, errTooLarge) {
+		if t.oversized != nil {
+			t.oversized(err)
+		}
+		n, _ = writeFrame(conn, &envelope{Error: err.Error()})
+		t.count(n, 0)
+		return
+	} else if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	n, _ = writeFrame(conn, handleEnvelope(t.ctx, handler, &req))
+	t.count(n, 0)
+}
+
+// Addr returns the address the transport listens on
+func (t *TCPTransport) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Close stops receiving messages and closes the open connections
+func (t *TCPTransport) Close() error {
+	err := t.listener.Close()
+	t.cancel()
+	t.wg.Wait()
+	return err
+}
+
+// Send sends a message to the node at the given address and returns its response
+func (t *TCPTransport) Send(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	conn, err := t.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	n, err := writeFrame(conn, &envelope{Message: msg})
+	t.count(n, 0)
+	if err != nil {
+		return nil, err
+	}
+	var resp envelope
+	n, err = readFrame(conn, &resp, maxFrameSize)
+	t.count(0, n)
+	if err != nil {
+		return nil, err
+	}
+	return resp.open()
+}
+
+// writeFrame writes the JSON encoding of v, prefixed by its length,
+// and returns the number of bytes written
+func writeFrame(w io.Writer, v interface{}) (int, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	if len(body) > maxFrameSize {
+		return 0, fmt.Errorf("frame of %d bytes is too large", len(body))
+	}
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	return w.Write(frame)
+}
+
+// readFrame reads a length-prefixed JSON frame of at most max bytes
+// into v, and returns the number of bytes read
+func readFrame(r io.Reader, v interface{}, max int) (int, error) {
+	var header [4]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return n, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if int64(size) > int64(max) {
+		return n, fmt.Errorf("%w: frame of %d bytes", errTooLarge, size)
+	}
+	body := make([]byte, size)
+	m, err := io.ReadFull(r, body)
+	if err != nil {
+		return n + m, err
+	}
+	return n + m, json.Unmarshal(body, v)
+}
+
+// UDPTransport exchanges the messages as JSON datagrams. The response
+// is sent back to the address of the sender. Messages larger than a
+// datagram are refused, such as the large deltas of a big state, and
+// lost datagrams are not retransmitted. The datagrams received while
+// all the workers are busy are dropped.
+type UDPTransport struct {
+	trafficCounter
+	// conn is the connection the transport listens on.
+	conn net.PacketConn
+	// ctx is cancelled when the transport is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// maxSize is the maximum size of the received datagrams, if lower than maxDatagramSize.
+	maxSize int
+	// oversized is called with the datagrams larger than maxSize,
+	// and the responses larger than a datagram.
+	oversized func(error)
+}
+
+// NewUDPTransport creates a new UDPTransport
+func NewUDPTransport() *UDPTransport {
+	return &UDPTransport{}
+}
+
+// Listen starts receiving messages on the given address
+func (t *UDPTransport) Listen(addr string, handler Handler) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	workers := make(chan struct{}, udpWorkers)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			t.count(0, n)
+			if t.allowed(from) != nil {
+				// the sender is rate limited, the datagram is dropped
+				continue
+			}
+			if t.maxSize > 0 && n > t.maxSize {
+				t.refuse(from, fmt.Errorf("datagram of %d bytes exceeds %d bytes: %w", n, t.maxSize, errTooLarge))
+				continue
+			}
+			var req envelope
+			if err := json.Unmarshal(buf[:n], &req); err != nil {
+				continue
+			}
+			select {
+			case workers <- struct{}{}:
+			default:
+				// every worker is busy, the datagram is dropped like a lost one
+				continue
+			}
+			go func() {
+				defer func() { <-workers }()
+				body, err := json.Marshal(handleEnvelope(t.ctx, handler, &req))
+				if err != nil {
+					return
+				}
+				if len(body) > maxDatagramSize {
+					t.refuse(from, fmt.Errorf("response of %d bytes exceeds the size of a datagram: %w", len(body), errTooLarge))
+					return
+				}
+				if _, err := conn.WriteTo(body, from); err == nil {
+					t.count(len(body), 0)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// limitSize limits the size of the received datagrams, and registers
+// the function called with the datagrams and responses exceeding it
+func (t *UDPTransport) limitSize(max int, exceeded func(error)) {
+	t.maxSize = max
+	t.oversized = exceeded
+}
+
+// refuse reports the oversized message, and answers its error to the sender
+func (t *UDPTransport) refuse(to net.Addr, err error) {
+	if t.oversized != nil {
+		t.oversized(err)
+	}
+	body, _ := json.Marshal(&envelope{Error: err.Error()})
+	if _, err := t.conn.WriteTo(body, to); err == nil {
+		t.count(len(body), 0)
+	}
+}
+
+// Addr returns the address the transport listens on
+func (t *UDPTransport) Addr() string {
+	return t.conn.LocalAddr().String()
+}
+
+// Close stops receiving messages
+func (t *UDPTransport) Close() error {
+	t.cancel()
+	return t.conn.Close()
+}
+
+// Send sends a message to the node at the given address and returns its response
+func (t *UDPTransport) Send(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	body, err := json.Marshal(&envelope{Message: msg})
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDatagramSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the size of a datagram: %w", len(body), errTooLarge)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	if _, err := conn.Write(body); err != nil {
+		return nil, err
+	}
+	t.count(len(body), 0)
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	t.count(0, n)
+	var resp envelope
+	if err := json.Unmarshal(buf[:n], &resp); err != nil {
+		return nil, err
+	}
+	return resp.open()
+}
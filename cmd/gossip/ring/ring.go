@@ -0,0 +1,372 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package ring is a consistent hashing ring, that shards keys across nodes.
+//
+// Each node is placed on the ring at as many points as its weight times
+// the number of virtual nodes, and a key is owned by the nodes of the first
+// points following the hash of the key. Adding or removing a node only moves
+// the keys of its own points, and the subscribers of the ring are told which
+// ranges of hashes changed owners.
+package ring
+
+import (
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// defaultVirtualNodes is the default number of points of a node of weight 1.
+	defaultVirtualNodes = 100
+	// defaultReplicas is the default replication factor.
+	defaultReplicas = 3
+	// subscriptionBuffer is the number of changes buffered for a subscriber.
+	subscriptionBuffer = 64
+	// MaxWeight is the highest weight of a node, so that the number of
+	// points of a node stays bounded.
+	MaxWeight = 100
+)
+
+// Config is the configuration of a Ring.
+// Zero values are replaced by the defaults.
+type Config struct {
+	// VirtualNodes is the number of points of a node of weight 1.
+	VirtualNodes int
+	// Replicas is the replication factor, the number of owners of a key
+	// returned by Owners when n is 0, and watched by the subscribers.
+	Replicas int
+}
+
+// Node is a node of the ring.
+type Node struct {
+	// ID is the id of the node.
+	ID string `json:"id"`
+	// Weight is the share of the keys owned by the node, relative to the
+	// other nodes. Weights lower than 1 are replaced by 1, and weights
+	// higher than MaxWeight by MaxWeight.
+	Weight int `json:"weight"`
+}
+
+// Range is a range of hashes that changed owners. It starts after Start
+// and ends at End included, and wraps around the ring if Start >= End.
+type Range struct {
+	// Start is the hash preceding the range.
+	Start uint64 `json:"start"`
+	// End is the last hash of the range.
+	End uint64 `json:"end"`
+	// Old are the owners of the range before the change, the primary first.
+	Old []string `json:"old"`
+	// New are the owners of the range after the change, the primary first.
+	New []string `json:"new"`
+}
+
+// Contains returns true if the hash is in the range
+func (r Range) Contains(hash uint64) bool {
+	if r.Start < r.End {
+		return hash > r.Start && hash <= r.End
+	}
+	return hash > r.Start || hash <= r.End
+}
+
+// Change is a change of the nodes of the ring.
+type Change struct {
+	// Nodes are the nodes of the ring after the change, sorted by id.
+	Nodes []Node `json:"nodes"`
+	// Moved are the ranges whose owners changed, up to the replication factor.
+	Moved []Range `json:"moved"`
+}
+
+// point is a virtual node
+type point struct {
+	hash uint64
+	node string
+}
+
+// state is an immutable placement of the nodes on the ring
+type state struct {
+	nodes  []Node
+	points []point
+}
+
+// newState places the nodes on the ring
+func newState(nodes []Node, virtualNodes int) *state {
+	s := &state{nodes: nodes}
+	for _, node := range nodes {
+		for i := 0; i < node.Weight*virtualNodes; i++ {
+			s.points = append(s.points, point{hash: Hash(node.ID + "#" + strconv.Itoa(i)), node: node.ID})
+		}
+	}
+	sort.Slice(s.points, func(i, j int) bool {
+		if s.points[i].hash == s.points[j].hash {
+			return s.points[i].node < s.points[j].node
+		}
+		return s.points[i].hash < s.points[j].hash
+	})
+	return s
+}
+
+// owners returns the n distinct nodes of the first points at or after the hash
+func (s *state) owners(hash uint64, n int) []string {
+	if n > len(s.nodes) {
+		n = len(s.nodes)
+	}
+	if n == 0 {
+		return nil
+	}
+	result := make([]string, 0, n)
+	start := sort.Search(len(s.points), func(i int) bool {
+		return s.points[i].hash >= hash
+	})
+	for i := 0; i < len(s.points) && len(result) < n; i++ {
+		node := s.points[(start+i)%len(s.points)].node
+		if !contains(result, node) {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// moved returns the ranges whose first n owners differ between the two states
+func moved(from, to *state, n int) []Range {
+	var bounds []uint64
+	for _, points := range [][]point{from.points, to.points} {
+		for _, p := range points {
+			bounds = append(bounds, p.hash)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	bounds = unique(bounds)
+	var result []Range
+	for i, end := range bounds {
+		// the owners are the same for all the hashes of the range
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		oldOwners, newOwners := from.owners(end, n), to.owners(end, n)
+		if reflect.DeepEqual(oldOwners, newOwners) {
+			continue
+		}
+		if last := len(result) - 1; last >= 0 && result[last].End == start &&
+			reflect.DeepEqual(result[last].Old, oldOwners) && reflect.DeepEqual(result[last].New, newOwners) {
+			result[last].End = end
+			continue
+		}
+		result = append(result, Range{Start: start, End: end, Old: oldOwners, New: newOwners})
+	}
+	if len(result) > 1 {
+		// the last range may continue into the first one
+		first, last := result[0], result[len(result)-1]
+		if last.End == first.Start && reflect.DeepEqual(first.Old, last.Old) && reflect.DeepEqual(first.New, last.New) {
+			result[0].Start = last.Start
+			result = result[:len(result)-1]
+		}
+	}
+	return result
+}
+
+// Ring is a consistent hashing ring. It is safe for concurrent use.
+type Ring struct {
+	virtualNodes  int
+	replicas      int
+	state         *state
+	subscriptions map[chan Change]struct{}
+	lock          sync.RWMutex
+}
+
+// New returns an empty ring
+func New(config Config) *Ring {
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = defaultVirtualNodes
+	}
+	if config.Replicas <= 0 {
+		config.Replicas = defaultReplicas
+	}
+	return &Ring{
+		virtualNodes:  config.VirtualNodes,
+		replicas:      config.Replicas,
+		state:         &state{},
+		subscriptions: make(map[chan Change]struct{}),
+	}
+}
+
+// Hash returns the position of a key on the ring
+func Hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv spreads similar keys poorly, the bits are mixed again
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Owners returns the n nodes owning the key, the primary first.
+// If n is 0, it returns as many owners as the replication factor.
+// There are fewer owners if the ring has fewer than n nodes.
+func (r *Ring) Owners(key string, n int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if n <= 0 {
+		n = r.replicas
+	}
+	return r.state.owners(Hash(key), n)
+}
+
+// Owner returns the primary owner of the key, or "" if the ring is empty
+func (r *Ring) Owner(key string) string {
+	owners := r.Owners(key, 1)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+// Nodes returns the nodes of the ring, sorted by id
+func (r *Ring) Nodes() []Node {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return append([]Node(nil), r.state.nodes...)
+}
+
+// Set replaces the nodes of the ring, and returns the ranges
+// whose owners changed. It does nothing if the nodes are the same.
+func (r *Ring) Set(nodes ...Node) []Range {
+	byID := make(map[string]Node)
+	for _, node := range nodes {
+		if node.Weight < 1 {
+			node.Weight = 1
+		}
+		if node.Weight > MaxWeight {
+			node.Weight = MaxWeight
+		}
+		byID[node.ID] = node
+	}
+	sorted := make([]Node, 0, len(byID))
+	for _, node := range byID {
+		sorted = append(sorted, node)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if reflect.DeepEqual(sorted, r.state.nodes) || len(sorted) == 0 && len(r.state.nodes) == 0 {
+		return nil
+	}
+	next := newState(sorted, r.virtualNodes)
+	change := Change{
+		Nodes: append([]Node(nil), sorted...),
+		Moved: moved(r.state, next, r.replicas),
+	}
+	r.state = next
+	r.publish(change)
+	return change.Moved
+}
+
+// Add adds a node to the ring, or changes its weight,
+// and returns the ranges whose owners changed
+func (r *Ring) Add(node Node) []Range {
+	nodes := r.Nodes()
+	for i := range nodes {
+		if nodes[i].ID == node.ID {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
+		}
+	}
+	return r.Set(append(nodes, node)...)
+}
+
+// Remove removes a node from the ring,
+// and returns the ranges whose owners changed
+func (r *Ring) Remove(id string) []Range {
+	var nodes []Node
+	for _, node := range r.Nodes() {
+		if node.ID != id {
+			nodes = append(nodes, node)
+		}
+	}
+	return r.Set(nodes...)
+}
+
+// Subscribe returns a channel that receives the changes of the ring, and a
+// function to cancel the subscription. The channel is closed when the
+// subscription is canceled, or if the subscriber does not keep up.
+func (r *Ring) Subscribe() (<-chan Change, func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	changes := make(chan Change, subscriptionBuffer)
+	r.subscriptions[changes] = struct{}{}
+	cancel := func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.unsubscribe(changes)
+	}
+	return changes, cancel
+}
+
+// unsubscribe removes the subscription and closes its channel.
+// It must be called with the lock held.
+func (r *Ring) unsubscribe(changes chan Change) {
+	if _, ok := r.subscriptions[changes]; !ok {
+		return
+	}
+	delete(r.subscriptions, changes)
+	close(changes)
+}
+
+// publish sends the change to the subscribers.
+// It must be called with the lock held.
+func (r *Ring) publish(change Change) {
+	for changes := range r.subscriptions {
+		select {
+		case changes <- change:
+		default:
+			r.unsubscribe(changes)
+		}
+	}
+}
+
+// contains returns true if the node is in the list
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// unique removes the consecutive duplicates of the sorted hashes
+func unique(hashes []uint64) []uint64 {
+	var result []uint64
+	for i, h := range hashes {
+		if i == 0 || h != hashes[i-1] {
+			result = append(result, h)
+		}
+	}
+	return result
+}
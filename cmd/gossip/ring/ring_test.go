@@ -0,0 +1,154 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ring
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// shares returns the share of the keys owned by each node
+func shares(r *Ring, keys int) map[string]float64 {
+	result := make(map[string]float64)
+	for i := 0; i < keys; i++ {
+		result[r.Owner("key-"+strconv.Itoa(i))] += 1 / float64(keys)
+	}
+	return result
+}
+
+func TestOwners(t *testing.T) {
+	r := New(Config{})
+	assert.Empty(t, r.Owners("a", 2))
+	assert.Equal(t, "", r.Owner("a"))
+
+	r.Set(Node{ID: "a"}, Node{ID: "b"}, Node{ID: "c"}, Node{ID: "d"})
+	owners := r.Owners("key", 3)
+	assert.Len(t, owners, 3)
+	assert.Equal(t, owners[0], r.Owner("key"))
+	assert.NotEqual(t, owners[0], owners[1])
+	assert.NotEqual(t, owners[1], owners[2])
+	assert.NotEqual(t, owners[0], owners[2])
+	assert.Equal(t, owners, r.Owners("key", 0))
+	assert.Len(t, r.Owners("key", 10), 4)
+
+	// the placement only depends on the nodes
+	other := New(Config{})
+	other.Set(Node{ID: "d"}, Node{ID: "c"}, Node{ID: "b"}, Node{ID: "a"})
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		assert.Equal(t, r.Owners(key, 2), other.Owners(key, 2))
+	}
+}
+
+func TestWeights(t *testing.T) {
+	r := New(Config{})
+	r.Set(Node{ID: "a", Weight: 1}, Node{ID: "b", Weight: 3})
+	s := shares(r, 10000)
+	assert.InDelta(t, 0.25, s["a"], 0.05)
+	assert.InDelta(t, 0.75, s["b"], 0.05)
+
+	r.Set(Node{ID: "a"}, Node{ID: "b"}, Node{ID: "c"}, Node{ID: "d"})
+	for _, share := range shares(r, 10000) {
+		assert.InDelta(t, 0.25, share, 0.05)
+	}
+
+	// the weights are bounded
+	r.Set(Node{ID: "a", Weight: -1}, Node{ID: "b", Weight: MaxWeight + 1})
+	assert.Equal(t, []Node{{ID: "a", Weight: 1}, {ID: "b", Weight: MaxWeight}}, r.Nodes())
+	assert.Len(t, r.state.points, (1+MaxWeight)*defaultVirtualNodes)
+}
+
+func TestMoved(t *testing.T) {
+	r := New(Config{Replicas: 1})
+	r.Set(Node{ID: "a"}, Node{ID: "b"}, Node{ID: "c"})
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		before[key] = r.Owner(key)
+	}
+
+	ranges := r.Add(Node{ID: "d"})
+	assert.NotEmpty(t, ranges)
+	changed := 0
+	for key, owner := range before {
+		hash := Hash(key)
+		var in *Range
+		for i := range ranges {
+			if ranges[i].Contains(hash) {
+				in = &ranges[i]
+				break
+			}
+		}
+		if r.Owner(key) == owner {
+			assert.Nil(t, in, key)
+			continue
+		}
+		// only the keys of the new node move, from their previous owner
+		changed++
+		if assert.NotNil(t, in, key) {
+			assert.Equal(t, []string{owner}, in.Old)
+			assert.Equal(t, []string{"d"}, in.New)
+		}
+	}
+	assert.InDelta(t, 250, changed, 60)
+
+	assert.Nil(t, r.Add(Node{ID: "d"}))
+	ranges = r.Remove("d")
+	for _, rg := range ranges {
+		assert.Equal(t, []string{"d"}, rg.Old)
+	}
+	for key, owner := range before {
+		assert.Equal(t, owner, r.Owner(key))
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	assert.True(t, Range{Start: 1, End: 3}.Contains(3))
+	assert.False(t, Range{Start: 1, End: 3}.Contains(1))
+	assert.True(t, Range{Start: 10, End: 3}.Contains(math.MaxUint64))
+	assert.True(t, Range{Start: 10, End: 3}.Contains(0))
+	assert.False(t, Range{Start: 10, End: 3}.Contains(5))
+	assert.True(t, Range{Start: 3, End: 3}.Contains(5))
+}
+
+func TestSubscribe(t *testing.T) {
+	r := New(Config{})
+	changes, cancel := r.Subscribe()
+	r.Set(Node{ID: "a"})
+	change := <-changes
+	assert.Equal(t, []Node{{ID: "a", Weight: 1}}, change.Nodes)
+	assert.Equal(t, []Range{{Start: change.Moved[0].Start, End: change.Moved[0].Start, New: []string{"a"}}}, change.Moved)
+
+	// nothing changes
+	r.Set(Node{ID: "a", Weight: 1})
+	assert.Empty(t, changes)
+
+	cancel()
+	_, ok := <-changes
+	assert.False(t, ok)
+	r.Set()
+}
@@ -0,0 +1,145 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// errRejected is the error of the messages that fail the authentication
+var errRejected = errors.New("message rejected")
+
+// Keyring holds the shared keys that encrypt the gossip messages.
+//
+// The messages are sealed with AES-GCM, which also authenticates them, so
+// that only the nodes knowing a key can read or forge messages. Messages
+// are sealed with the primary key, and opened with any key of the keyring.
+// To rotate the keys without downtime, first add the new key to every node
+// as a secondary key, then make it the primary key of every node, and
+// finally remove the old key.
+type Keyring struct {
+	// aeads are the ciphers of the keys, the primary first.
+	aeads []cipher.AEAD
+}
+
+// NewKeyring creates a keyring from the given keys, the primary first.
+// The keys must be 16, 24 or 32 bytes long, to select AES-128, AES-192
+// or AES-256.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("empty keyring")
+	}
+	k := &Keyring{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads = append(k.aeads, aead)
+	}
+	return k, nil
+}
+
+// seal returns a message of the same type that carries
+// the given message encrypted with the primary key
+func (k *Keyring) seal(msg *Message) (*Message, error) {
+	plaintext, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	aead := k.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// the type is authenticated too, as it travels in clear
+	return &Message{
+		Type:   msg.Type,
+		Sealed: aead.Seal(nonce, nonce, plaintext, []byte(msg.Type)),
+	}, nil
+}
+
+// open returns the message carried by the given sealed message
+func (k *Keyring) open(msg *Message) (*Message, error) {
+	if msg.Sealed == nil {
+		return nil, fmt.Errorf("%w: message is not sealed", errRejected)
+	}
+	for _, aead := range k.aeads {
+		if len(msg.Sealed) < aead.NonceSize() {
+			break
+		}
+		nonce, ciphertext := msg.Sealed[:aead.NonceSize()], msg.Sealed[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(msg.Type))
+		if err != nil {
+			continue
+		}
+		var result Message
+		if err := json.Unmarshal(plaintext, &result); err != nil {
+			return nil, err
+		}
+		if result.Type != msg.Type {
+			return nil, fmt.Errorf("%w: message type does not match", errRejected)
+		}
+		return &result, nil
+	}
+	return nil, fmt.Errorf("%w: no key opens the message", errRejected)
+}
+
+// LoadMutualTLS returns the TLS configuration of a node that presents the
+// given certificate, and only trusts the nodes whose certificate is signed
+// by the given certificate authority, both as a server and as a client
+func LoadMutualTLS(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
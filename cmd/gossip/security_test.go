@@ -0,0 +1,199 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	old, err := NewKeyring(oldKey)
+	assert.NoError(t, err)
+	rotated, err := NewKeyring(newKey, oldKey)
+	assert.NoError(t, err)
+	other, err := NewKeyring(newKey)
+	assert.NoError(t, err)
+	_, err = NewKeyring([]byte("short"))
+	assert.Error(t, err)
+
+	msg := &Message{Type: MessagePing, From: "a", Members: []Member{{ID: "b", Status: StatusAlive}}}
+	sealed, err := old.seal(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, MessagePing, sealed.Type)
+	assert.Empty(t, sealed.From)
+
+	// the rotated keyring still opens the messages of the old key
+	opened, err := rotated.open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, opened)
+
+	_, err = other.open(sealed)
+	assert.ErrorIs(t, err, errRejected)
+
+	_, err = old.open(msg)
+	assert.ErrorIs(t, err, errRejected)
+
+	sealed.Type = MessageSyn
+	_, err = old.open(sealed)
+	assert.ErrorIs(t, err, errRejected)
+}
+
+func TestServerKeyring(t *testing.T) {
+	ctx := context.Background()
+	network := NewMemoryNetwork()
+	newServer := func(id string, key string) *Server {
+		config := Config{Transport: network.Transport()}
+		if key != "" {
+			keyring, err := NewKeyring([]byte(key))
+			assert.NoError(t, err)
+			config.Keyring = keyring
+		}
+		s := NewServer([]string{}, config)
+		assert.NoError(t, s.listen(id))
+		return s
+	}
+	s1 := newServer("s1", "0123456789abcdef")
+	s2 := newServer("s2", "0123456789abcdef")
+	s3 := newServer("s3", "fedcba9876543210")
+	s4 := newServer("s4", "")
+
+	s2.gossip(ctx, "s1")
+	assert.Contains(t, s2.metadata, "s1")
+	assert.Contains(t, s1.metadata, "s2")
+
+	s3.gossip(ctx, "s1")
+	s4.gossip(ctx, "s1")
+	assert.NotContains(t, s3.metadata, "s1")
+	assert.NotContains(t, s4.metadata, "s1")
+	assert.NotContains(t, s1.metadata, "s3")
+	assert.NotContains(t, s1.metadata, "s4")
+	assert.Equal(t, uint64(2), s1.metrics.get(&s1.metrics.rejected))
+}
+
+// writePEM writes a PEM block to a file of the given directory
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+// newTestTLS returns the mutual TLS configuration of a node
+// with a certificate signed by a new certificate authority
+func newTestTLS(t *testing.T) *tls.Config {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gossip ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gossip node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	config, err := LoadMutualTLS(
+		writePEM(t, dir, "node.crt", "CERTIFICATE", certDER),
+		writePEM(t, dir, "node.key", "EC PRIVATE KEY", keyDER),
+		writePEM(t, dir, "ca.crt", "CERTIFICATE", caDER),
+	)
+	assert.NoError(t, err)
+	return config
+}
+
+func TestTLSTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	config := newTestTLS(t)
+
+	server := NewTLSTransport(config)
+	var lock sync.Mutex
+	var rejected []error
+	server.onReject(func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		rejected = append(rejected, err)
+	})
+	err := server.Listen("127.0.0.1:0", func(ctx context.Context, msg *Message) (*Message, error) {
+		return &Message{Type: MessageAck, From: "server"}, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+
+	ack, err := NewTLSTransport(config).Send(ctx, server.Addr(), &Message{Type: MessagePing})
+	assert.NoError(t, err)
+	assert.Equal(t, &Message{Type: MessageAck, From: "server"}, ack)
+
+	// a node without certificate cannot connect
+	_, err = NewTLSTransport(&tls.Config{RootCAs: config.RootCAs}).Send(ctx, server.Addr(), &Message{Type: MessagePing})
+	assert.Error(t, err)
+	plain := NewHTTPTransport()
+	plain.Codec = JSONCodec
+	_, err = plain.Send(ctx, server.Addr(), &Message{Type: MessagePing})
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(rejected) == 2
+	}, time.Second, 10*time.Millisecond)
+}
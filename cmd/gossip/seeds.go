@@ -0,0 +1,288 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SeedProvider provides the addresses of the seed nodes. The seeds are
+// polled periodically, so that a node can find the cluster again after
+// the nodes it knew are gone, or after a partition.
+type SeedProvider interface {
+	// Seeds returns the addresses of the seed nodes.
+	Seeds(ctx context.Context) ([]string, error)
+}
+
+// StaticSeeds is a fixed list of seed addresses.
+type StaticSeeds []string
+
+// Seeds returns the addresses of the list
+func (s StaticSeeds) Seeds(ctx context.Context) ([]string, error) {
+	return s, nil
+}
+
+// FileSeeds reads the seed addresses from a file, one per line. Empty
+// lines and lines starting with # are ignored. The file is read again
+// every time the seeds are polled, so it can be edited while the node runs.
+type FileSeeds struct {
+	// Path is the path of the file.
+	Path string
+}
+
+// Seeds returns the addresses of the file
+func (s FileSeeds) Seeds(ctx context.Context) ([]string, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var result []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, line)
+	}
+	return result, scanner.Err()
+}
+
+// Resolver resolves the DNS names of the seeds. A *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+}
+
+// DNSSeeds looks up the seed addresses in the DNS. With a service, the SRV
+// records of _service._proto.name give the hosts and ports of the seeds.
+// Without, the A and AAAA records of the name give the hosts of the seeds,
+// which all listen on the same port.
+type DNSSeeds struct {
+	// Name is the DNS name of the seeds.
+	Name string
+	// Service is the service of the SRV records, if any.
+	Service string
+	// Proto is the protocol of the SRV records, the one of the transport,
+	// tcp or udp. It defaults to tcp.
+	Proto string
+	// Port is the port of the seeds, without service.
+	Port int
+	// Resolver resolves the name. It defaults to net.DefaultResolver.
+	Resolver Resolver
+}
+
+// Seeds returns the addresses of the DNS records
+func (s DNSSeeds) Seeds(ctx context.Context) ([]string, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var result []string
+	if s.Service != "" {
+		proto := s.Proto
+		if proto == "" {
+			proto = "tcp"
+		}
+		_, records, err := resolver.LookupSRV(ctx, s.Service, proto, s.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			result = append(result, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		return result, nil
+	}
+	hosts, err := resolver.LookupHost(ctx, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		result = append(result, net.JoinHostPort(host, strconv.Itoa(s.Port)))
+	}
+	return result, nil
+}
+
+// NewDNSResolver returns a resolver that sends its queries
+// to the DNS server at the given address (host:port)
+func NewDNSResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// pollSeeds returns the sorted and deduplicated seeds of the providers.
+// The seeds of a failing provider are the ones it returned last time.
+func pollSeeds(ctx context.Context, providers []SeedProvider, last map[int][]string) ([]string, error) {
+	var errs []string
+	unique := make(map[string]bool)
+	for i, provider := range providers {
+		seeds, err := provider.Seeds(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+			seeds = last[i]
+		} else {
+			last[i] = seeds
+		}
+		for _, seed := range seeds {
+			unique[seed] = true
+		}
+	}
+	result := make([]string, 0, len(unique))
+	for seed := range unique {
+		result = append(result, seed)
+	}
+	sort.Strings(result)
+	if len(errs) > 0 {
+		return result, fmt.Errorf("error polling seeds: %s", strings.Join(errs, "; "))
+	}
+	return result, nil
+}
+
+// refreshSeeds polls the seed providers, and replaces the seed nodes
+func (s *Server) refreshSeeds(ctx context.Context) {
+	ctx, cancel := s.withTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	seeds, err := pollSeeds(ctx, s.seedProviders, s.lastSeeds)
+	if err != nil {
+		s.logger.Warn("error polling seeds", "error", err)
+	}
+	addrs := resolveSeeds(ctx, s.resolver, seeds)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seedNodes = seeds
+	s.seedAddrs = addrs
+}
+
+// resolveSeeds returns the addresses of each seed, the seed itself followed
+// by its host resolved to IP addresses, as found in the ids of the members.
+// The seeds whose host cannot be resolved only have their own address.
+func resolveSeeds(ctx context.Context, resolver Resolver, seeds []string) map[string][]string {
+	result := make(map[string][]string, len(seeds))
+	for _, seed := range seeds {
+		result[seed] = []string{seed}
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil || host == "" || net.ParseIP(host) != nil {
+			continue
+		}
+		ips, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			result[seed] = append(result[seed], net.JoinHostPort(ip, port))
+		}
+	}
+	return result
+}
+
+// isLocal returns true if the address is the one of the local node. The id of
+// the node has an unspecified host, such as [::]:8080, if it listens on all
+// its interfaces, and then the addresses of its interfaces are local too.
+func (s *Server) isLocal(addr string) bool {
+	if addr == s.id {
+		return true
+	}
+	idHost, idPort, err := net.SplitHostPort(s.id)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != idPort {
+		return false
+	}
+	idIP, ip := net.ParseIP(idHost), net.ParseIP(host)
+	if idIP == nil || ip == nil {
+		return false
+	}
+	if ip.Equal(idIP) || idIP.IsUnspecified() && ip.IsLoopback() {
+		return true
+	}
+	if !idIP.IsUnspecified() {
+		return false
+	}
+	interfaces, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range interfaces {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lostSeeds returns the seeds that are neither the local node nor a live
+// node, comparing their resolved addresses. It must be called with the lock held.
+func (s *Server) lostSeeds() []string {
+	live := make(map[string]bool)
+	for _, node := range s.liveNodes() {
+		live[node] = true
+	}
+	var result []string
+	for _, seed := range s.seedNodes {
+		addrs, ok := s.seedAddrs[seed]
+		if !ok {
+			addrs = []string{seed}
+		}
+		lost := true
+		for _, addr := range addrs {
+			if live[addr] || s.isLocal(addr) {
+				lost = false
+				break
+			}
+		}
+		if lost {
+			result = append(result, seed)
+		}
+	}
+	return result
+}
+
+// gossipSeed gossips with a random seed that is not a live node, so that
+// the node finds the nodes it lost contact with, such as after a partition
+func (s *Server) gossipSeed(ctx context.Context) {
+	s.lock.Lock()
+	seed := randomNode(s.rand, s.lostSeeds())
+	s.lock.Unlock()
+	if seed == "" {
+		return
+	}
+	s.gossip(ctx, seed)
+}
@@ -0,0 +1,184 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves names from fixed records
+type fakeResolver struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+// LookupHost returns the hosts of the name
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	hosts, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return hosts, nil
+}
+
+// LookupSRV returns the SRV records of the service
+func (r fakeResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	records, ok := r.srv["_"+service+"._"+proto+"."+name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return name, records, nil
+}
+
+// failingSeeds is a seed provider that fails once broken
+type failingSeeds struct {
+	seeds  []string
+	broken *bool
+}
+
+// Seeds returns the seeds unless broken
+func (s failingSeeds) Seeds(ctx context.Context) ([]string, error) {
+	if *s.broken {
+		return nil, errors.New("broken")
+	}
+	return s.seeds, nil
+}
+
+func TestFileSeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+	assert.NoError(t, os.WriteFile(path, []byte("# seeds\nlocalhost:8080\n\n  localhost:8081  \n"), 0644))
+	seeds, err := FileSeeds{Path: path}.Seeds(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"localhost:8080", "localhost:8081"}, seeds)
+
+	// the file is read again
+	assert.NoError(t, os.WriteFile(path, []byte("localhost:8082\n"), 0644))
+	seeds, err = FileSeeds{Path: path}.Seeds(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"localhost:8082"}, seeds)
+
+	_, err = FileSeeds{Path: filepath.Join(t.TempDir(), "missing")}.Seeds(context.Background())
+	assert.Error(t, err)
+}
+
+func TestDNSSeeds(t *testing.T) {
+	resolver := fakeResolver{
+		hosts: map[string][]string{
+			"gossip.local": {"10.0.0.1", "fd00::1"},
+		},
+		srv: map[string][]*net.SRV{
+			"_gossip._tcp.gossip.local": {
+				{Target: "a.gossip.local.", Port: 8080},
+				{Target: "b.gossip.local.", Port: 8081},
+			},
+			"_gossip._udp.gossip.local": {
+				{Target: "c.gossip.local.", Port: 8082},
+			},
+		},
+	}
+	seeds, err := DNSSeeds{Name: "gossip.local", Port: 8080, Resolver: resolver}.Seeds(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "[fd00::1]:8080"}, seeds)
+
+	seeds, err = DNSSeeds{Name: "gossip.local", Service: "gossip", Resolver: resolver}.Seeds(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.gossip.local:8080", "b.gossip.local:8081"}, seeds)
+
+	seeds, err = DNSSeeds{Name: "gossip.local", Service: "gossip", Proto: "udp", Resolver: resolver}.Seeds(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c.gossip.local:8082"}, seeds)
+
+	_, err = DNSSeeds{Name: "missing.local", Port: 8080, Resolver: resolver}.Seeds(context.Background())
+	assert.Error(t, err)
+}
+
+func TestPollSeeds(t *testing.T) {
+	broken := false
+	providers := []SeedProvider{
+		StaticSeeds{"c", "a"},
+		failingSeeds{seeds: []string{"b", "a"}, broken: &broken},
+	}
+	last := make(map[int][]string)
+	seeds, err := pollSeeds(context.Background(), providers, last)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, seeds)
+
+	// a failing provider keeps its previous seeds
+	broken = true
+	seeds, err = pollSeeds(context.Background(), providers, last)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, seeds)
+}
+
+func TestGossipSeed(t *testing.T) {
+	network := NewMemoryNetwork()
+	config := Config{Interval: time.Hour}
+	config.Transport = network.Transport()
+	s1 := NewServer([]string{}, config)
+	config.Transport = network.Transport()
+	config.SeedProviders = []SeedProvider{StaticSeeds{"a"}}
+	s2 := NewServer([]string{}, config)
+	assert.NoError(t, s1.listen("a"))
+	assert.NoError(t, s2.listen("b"))
+	defer s1.transport.Close()
+	defer s2.transport.Close()
+
+	s2.refreshSeeds(context.Background())
+	assert.Equal(t, []string{"a"}, s2.seedNodes)
+	s2.gossipSeed(context.Background())
+	assert.True(t, hasAliveMember(s2, "a"))
+}
+
+func TestLostSeeds(t *testing.T) {
+	s := newTestServer("127.0.0.1:8080", time.Now)
+	s.resolver = fakeResolver{hosts: map[string][]string{
+		"localhost":  {"127.0.0.1", "::1"},
+		"b.local":    {"192.0.2.2"},
+		"c.local":    {"192.0.2.3"},
+		"gone.local": {"192.0.2.4"},
+	}}
+	s.seedProviders = []SeedProvider{StaticSeeds{"localhost:8080", "b.local:8080", "c.local:8080", "gone.local:8080", "missing.local:8080"}}
+	s.refreshSeeds(context.Background())
+	now := time.Now()
+	s.applyUpdate(Member{ID: "192.0.2.2:8080", Address: "192.0.2.2:8080", Status: StatusAlive}, now)
+	s.applyUpdate(Member{ID: "192.0.2.3:8080", Address: "192.0.2.3:8080", Status: StatusSuspect}, now)
+	s.applyUpdate(Member{ID: "192.0.2.4:8080", Address: "192.0.2.4:8080", Status: StatusDead}, now)
+
+	// the local node and the live nodes are found by their resolved addresses
+	assert.Equal(t, []string{"gone.local:8080", "missing.local:8080"}, s.lostSeeds())
+
+	// a node listening on all its interfaces is reached through the loopback
+	s.id = "[::]:8080"
+	assert.True(t, s.isLocal("127.0.0.1:8080"))
+	assert.True(t, s.isLocal("[::1]:8080"))
+	assert.False(t, s.isLocal("127.0.0.1:8081"))
+}
@@ -0,0 +1,399 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// This file implements a deterministic network simulator.
+//
+// The simulated nodes run one at a time on a virtual clock: their gossip
+// rounds and probes are events of a queue ordered by virtual time, and the
+// messages are delivered synchronously, moving the clock forward by their
+// latency. A lost message moves the clock forward by the timeout of the
+// sender. Every random choice derives from the seed of the simulation, so
+// the same seed always gives the same run.
+
+// SimConfig is the configuration of a simulation.
+type SimConfig struct {
+	// Seed seeds all the random choices of the simulation.
+	Seed int64
+	// Nodes is the number of simulated nodes.
+	Nodes int
+	// Config is the configuration of the nodes. Its transport is ignored.
+	Config Config
+	// Latency is the minimum one-way delay of a message.
+	Latency time.Duration
+	// Jitter is the maximum random delay added to the latency.
+	Jitter time.Duration
+	// Loss is the probability of a message to be lost, between 0 and 1.
+	Loss float64
+}
+
+// Simulation is a simulated network of gossip servers.
+type Simulation struct {
+	// config is the configuration of the simulation.
+	config SimConfig
+	// rand draws the latencies and the losses.
+	rand *rand.Rand
+	// start is the virtual time the simulation started at.
+	start time.Time
+	// now is the current virtual time.
+	now time.Time
+	// ids are the ids of the nodes, in creation order.
+	ids []string
+	// servers are the simulated servers, by id.
+	servers map[string]*Server
+	// handlers are the message handlers of the running nodes, by id.
+	handlers map[string]Handler
+	// groups are the partition groups of the nodes. Nodes of different
+	// groups cannot reach each other.
+	groups map[string]int
+	// events are the pending gossip rounds, probes and polls of the seeds.
+	events simEvents
+	// seq orders the events scheduled at the same time.
+	seq int
+}
+
+// NewSimulation creates a simulation of the configured number of nodes,
+// all seeded with the first one
+func NewSimulation(config SimConfig) *Simulation {
+	sim := &Simulation{
+		config:   config,
+		rand:     rand.New(rand.NewSource(config.Seed)),
+		start:    time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		servers:  make(map[string]*Server),
+		handlers: make(map[string]Handler),
+		groups:   make(map[string]int),
+	}
+	sim.now = sim.start
+	for i := 0; i < config.Nodes; i++ {
+		sim.Add()
+	}
+	return sim
+}
+
+// Add starts a new node seeded with the first running one, and returns its id
+func (sim *Simulation) Add() string {
+	id := fmt.Sprintf("node-%d", len(sim.ids))
+	var seeds []string
+	for _, seed := range sim.ids {
+		if _, ok := sim.handlers[seed]; ok {
+			seeds = []string{seed}
+			break
+		}
+	}
+	s := NewServer(seeds, sim.config.Config)
+	s.transport = &simTransport{sim: sim}
+	s.now = sim.Now
+	s.rand = rand.New(rand.NewSource(sim.rand.Int63()))
+	s.serial = true
+	if err := s.listen(id); err != nil {
+		panic(err)
+	}
+	sim.ids = append(sim.ids, id)
+	sim.servers[id] = s
+	sim.schedule(id, simGossip, time.Duration(sim.rand.Int63n(int64(s.config.Interval))))
+	sim.schedule(id, simProbe, time.Duration(sim.rand.Int63n(int64(s.config.ProbeInterval))))
+	sim.schedule(id, simSeeds, s.config.SeedInterval)
+	return id
+}
+
+// Nodes returns the ids of the nodes
+func (sim *Simulation) Nodes() []string {
+	return sim.ids
+}
+
+// Server returns the server of the given node
+func (sim *Simulation) Server(id string) *Server {
+	return sim.servers[id]
+}
+
+// Now returns the current virtual time
+func (sim *Simulation) Now() time.Time {
+	return sim.now
+}
+
+// Elapsed returns the virtual time elapsed since the start of the simulation
+func (sim *Simulation) Elapsed() time.Duration {
+	return sim.now.Sub(sim.start)
+}
+
+// Set sets a key of the given node
+func (sim *Simulation) Set(id string, key string, value string) {
+	s := sim.servers[id]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addLocalState(key, value)
+}
+
+// Metadata returns a copy of the metadata of the given node
+func (sim *Simulation) Metadata(id string) ClusterMetadata {
+	s := sim.servers[id]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return deltaSince(s.metadata, Digest{})
+}
+
+// Partition splits the network in the given groups of nodes. The nodes
+// of different groups cannot reach each other, and the nodes of no group
+// can only reach each other.
+func (sim *Simulation) Partition(groups ...[]string) {
+	sim.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			sim.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal removes the partitions of the network
+func (sim *Simulation) Heal() {
+	sim.groups = make(map[string]int)
+}
+
+// Stop crashes the given node. It stops answering and sending messages.
+func (sim *Simulation) Stop(id string) {
+	delete(sim.handlers, id)
+}
+
+// Leave makes the given node leave the cluster on purpose, then stops it
+func (sim *Simulation) Leave(id string) {
+	start := sim.now
+	sim.servers[id].Leave(context.Background())
+	// the other nodes did not wait for this one
+	sim.now = start
+	sim.Stop(id)
+}
+
+// Converged returns true if the running nodes have the same
+// metadata, ignoring the heartbeats that change every round
+func (sim *Simulation) Converged() bool {
+	var metadata []ClusterMetadata
+	for _, id := range sim.ids {
+		if _, ok := sim.handlers[id]; ok {
+			metadata = append(metadata, sim.Metadata(id))
+		}
+	}
+	return sameMetadata(metadata)
+}
+
+// Run runs the simulation for the given virtual duration
+func (sim *Simulation) Run(d time.Duration) {
+	sim.RunUntil(func() bool { return false }, d)
+}
+
+// RunUntil runs the simulation until the condition is true, for at most
+// the given virtual duration, and returns true if the condition was met
+func (sim *Simulation) RunUntil(cond func() bool, limit time.Duration) bool {
+	end := sim.now.Add(limit)
+	for !cond() {
+		if len(sim.events) == 0 || sim.events[0].at.After(end) {
+			sim.now = end
+			return false
+		}
+		sim.step()
+	}
+	return true
+}
+
+// step runs the next event
+func (sim *Simulation) step() {
+	e := heap.Pop(&sim.events).(*simEvent)
+	if e.at.After(sim.now) {
+		sim.now = e.at
+	}
+	if _, ok := sim.handlers[e.node]; !ok {
+		// stopped nodes do nothing
+		return
+	}
+	start := sim.now
+	s := sim.servers[e.node]
+	switch e.kind {
+	case simProbe:
+		s.probe(context.Background())
+		sim.schedule(e.node, simProbe, sim.now.Sub(start)+s.config.ProbeInterval)
+	case simSeeds:
+		s.refreshSeeds(context.Background())
+		s.gossipSeed(context.Background())
+		sim.schedule(e.node, simSeeds, sim.now.Sub(start)+s.config.SeedInterval)
+	default:
+		s.doGossip(context.Background())
+		sim.schedule(e.node, simGossip, sim.now.Sub(start)+s.config.Interval)
+	}
+	// the other nodes did not wait for this one
+	sim.now = start
+}
+
+// schedule schedules an event of the given node after the given delay
+func (sim *Simulation) schedule(id string, kind simEventKind, after time.Duration) {
+	sim.seq++
+	heap.Push(&sim.events, &simEvent{
+		at:   sim.now.Add(after),
+		seq:  sim.seq,
+		node: id,
+		kind: kind,
+	})
+}
+
+// reachable returns true if the message from a to b is delivered
+func (sim *Simulation) reachable(a, b string) bool {
+	if sim.groups[a] != sim.groups[b] {
+		return false
+	}
+	return sim.rand.Float64() >= sim.config.Loss
+}
+
+// latency returns the delay of a message
+func (sim *Simulation) latency() time.Duration {
+	d := sim.config.Latency
+	if sim.config.Jitter > 0 {
+		d += time.Duration(sim.rand.Int63n(int64(sim.config.Jitter)))
+	}
+	return d
+}
+
+// simTransport is the transport of a simulated node
+type simTransport struct {
+	sim  *Simulation
+	addr string
+}
+
+// Listen attaches the node to the simulated network
+func (t *simTransport) Listen(addr string, handler Handler) error {
+	if _, ok := t.sim.handlers[addr]; ok {
+		return fmt.Errorf("address %s already in use", addr)
+	}
+	t.sim.handlers[addr] = handler
+	t.addr = addr
+	return nil
+}
+
+// Addr returns the address of the node
+func (t *simTransport) Addr() string {
+	return t.addr
+}
+
+// Close detaches the node from the simulated network
+func (t *simTransport) Close() error {
+	t.sim.Stop(t.addr)
+	return nil
+}
+
+// Send delivers the message, moving the virtual clock forward by the
+// latency of the message and of its response. A lost message moves
+// the virtual clock forward to the deadline of the request.
+func (t *simTransport) Send(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	sim := t.sim
+	handler, ok := sim.handlers[addr]
+	if !ok {
+		return nil, fmt.Errorf("no node listening on %s", addr)
+	}
+	deadline, ok := ctx.Value(deadlineKey{}).(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("no virtual deadline for the message to %s", addr)
+	}
+	expire := func() (*Message, error) {
+		if deadline.After(sim.now) {
+			sim.now = deadline
+		}
+		return nil, context.DeadlineExceeded
+	}
+
+	if !sim.reachable(t.addr, addr) {
+		return expire()
+	}
+	sim.now = sim.now.Add(sim.latency())
+	req, err := copyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !sim.reachable(addr, t.addr) {
+		return expire()
+	}
+	sim.now = sim.now.Add(sim.latency())
+	if sim.now.After(deadline) {
+		return expire()
+	}
+	return copyMessage(resp)
+}
+
+// simEventKind is the kind of a simulated event
+type simEventKind int
+
+const (
+	// simGossip is a gossip round.
+	simGossip simEventKind = iota
+	// simProbe is a failure detection probe.
+	simProbe
+	// simSeeds is a poll of the seeds.
+	simSeeds
+)
+
+// simEvent is a gossip round, a probe or a poll of the seeds of a simulated node
+type simEvent struct {
+	at   time.Time
+	seq  int
+	node string
+	kind simEventKind
+}
+
+// simEvents is a priority queue of events, the earliest first
+type simEvents []*simEvent
+
+func (q simEvents) Len() int {
+	return len(q)
+}
+
+func (q simEvents) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q simEvents) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *simEvents) Push(x interface{}) {
+	*q = append(*q, x.(*simEvent))
+}
+
+func (q *simEvents) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,172 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newTestSimulation returns a lossy simulation where every node wrote a key
+func newTestSimulation(seed int64) *Simulation {
+	sim := NewSimulation(SimConfig{
+		Seed:    seed,
+		Nodes:   20,
+		Config:  Config{SuspicionTimeout: 10 * time.Second},
+		Latency: 5 * time.Millisecond,
+		Jitter:  10 * time.Millisecond,
+		Loss:    0.05,
+	})
+	for i, id := range sim.Nodes() {
+		sim.Set(id, "key", fmt.Sprint(i))
+	}
+	return sim
+}
+
+func TestSimulationConverges(t *testing.T) {
+	sim := newTestSimulation(1)
+	assert.True(t, sim.RunUntil(sim.Converged, time.Minute))
+	assert.Less(t, sim.Elapsed(), 20*time.Second)
+
+	metadata := sim.Metadata("node-0")
+	assert.Len(t, metadata, 20)
+	for i, id := range sim.Nodes() {
+		assert.Equal(t, fmt.Sprint(i), metadata[id]["key"].Value)
+	}
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	sim1 := newTestSimulation(42)
+	sim2 := newTestSimulation(42)
+	assert.True(t, sim1.RunUntil(sim1.Converged, time.Minute))
+	assert.True(t, sim2.RunUntil(sim2.Converged, time.Minute))
+	assert.Equal(t, sim1.Elapsed(), sim2.Elapsed())
+	for _, id := range sim1.Nodes() {
+		assert.Equal(t, sim1.Metadata(id), sim2.Metadata(id))
+	}
+}
+
+func TestSimulationPartition(t *testing.T) {
+	sim := newTestSimulation(7)
+	assert.True(t, sim.RunUntil(sim.Converged, time.Minute))
+
+	nodes := sim.Nodes()
+	sim.Partition(nodes[:10], nodes[10:])
+	sim.Set("node-0", "key", "a")
+	sim.Set("node-10", "key", "b")
+	sim.Run(5 * time.Second)
+	assert.False(t, sim.Converged())
+	assert.Equal(t, "a", sim.Metadata("node-9")["node-0"]["key"].Value)
+	assert.Equal(t, "10", sim.Metadata("node-9")["node-10"]["key"].Value)
+
+	sim.Heal()
+	assert.True(t, sim.RunUntil(sim.Converged, time.Minute))
+	assert.Equal(t, "b", sim.Metadata("node-9")["node-10"]["key"].Value)
+}
+
+func TestSimulationLongPartition(t *testing.T) {
+	sim := newTestSimulation(7)
+	assert.True(t, sim.RunUntil(sim.Converged, time.Minute))
+
+	// the groups declare each other dead, so only the seeds join them again
+	nodes := sim.Nodes()
+	sim.Partition(nodes[:10], nodes[10:])
+	sim.Run(30 * time.Second)
+	sim.Set("node-10", "key", "b")
+
+	sim.Heal()
+	updated := func() bool {
+		for _, id := range nodes[:10] {
+			if sim.Metadata(id)["node-10"]["key"].Value != "b" {
+				return false
+			}
+		}
+		return true
+	}
+	assert.True(t, sim.RunUntil(updated, time.Minute))
+
+	// the nodes refute the stale claims that they are dead
+	alive := func() bool {
+		for _, id := range nodes {
+			if len(sim.Server(id).liveNodes()) != len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}
+	assert.True(t, sim.RunUntil(alive, 2*time.Minute))
+}
+
+func TestSimulationCrash(t *testing.T) {
+	sim := newTestSimulation(3)
+	assert.True(t, sim.RunUntil(sim.Converged, time.Minute))
+
+	sim.Stop("node-5")
+	isDead := func() bool {
+		for _, id := range sim.Nodes() {
+			if id == "node-5" {
+				continue
+			}
+			s := sim.Server(id)
+			s.lock.RLock()
+			member := s.membership["node-5"]
+			s.lock.RUnlock()
+			if member.Status != StatusDead {
+				return false
+			}
+		}
+		return true
+	}
+	assert.True(t, sim.RunUntil(isDead, time.Minute))
+}
+
+func TestSimulationLeave(t *testing.T) {
+	sim := newTestSimulation(4)
+	assert.True(t, sim.RunUntil(sim.Converged, time.Minute))
+
+	sim.Leave("node-5")
+	hasLeft := func() bool {
+		for _, id := range sim.Nodes() {
+			if id == "node-5" {
+				continue
+			}
+			s := sim.Server(id)
+			s.lock.RLock()
+			member := s.membership["node-5"]
+			s.lock.RUnlock()
+			if member.Status != StatusLeft {
+				return false
+			}
+		}
+		return true
+	}
+	// the departure spreads faster than a failure is detected
+	assert.True(t, sim.RunUntil(hasLeft, sim.Server("node-0").config.SuspicionTimeout))
+	for _, id := range sim.Nodes() {
+		assert.NotContains(t, sim.Server(id).liveNodes(), "node-5")
+	}
+}
@@ -0,0 +1,311 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// snapshotFile is the name of the snapshot in the data directory.
+	snapshotFile = "snapshot.json"
+	// walFile is the name of the write-ahead log in the data directory.
+	walFile = "wal.log"
+	// oldWALFile is the name of the write-ahead log being replaced
+	// by a snapshot in the data directory.
+	oldWALFile = "wal.old.log"
+)
+
+// walRecord is a local write in the write-ahead log
+type walRecord struct {
+	Node  string        `json:"node"`
+	Key   string        `json:"key"`
+	Value *VersionedStr `json:"value"`
+}
+
+// store persists the state of a node in a data directory.
+//
+// The local writes are appended to a write-ahead log as they happen, and
+// the whole metadata is periodically written to a snapshot. When a snapshot
+// starts, the log is moved aside and a new one is started, and the old log
+// is removed once the snapshot is written. The state is recovered by
+// loading the snapshot and replaying the logs on top of it. Replaying a
+// write twice is harmless, because only the newer versions are kept.
+//
+// The appends do not wait for the disk, so that they can be done with the
+// lock of the server held. The writes are made durable by sync, which
+// syncs all the writes appended before it at once.
+type store struct {
+	// dir is the data directory.
+	dir string
+	// lock protects the logs and the number of appends. It is not
+	// held while waiting for the disk.
+	lock sync.Mutex
+	// wal is the write-ahead log, open for appending.
+	wal *os.File
+	// old is the log being replaced by a snapshot, if any.
+	old *os.File
+	// appended is the number of appends to make durable.
+	appended uint64
+	// rotated is true if the logs were renamed since the last sync.
+	rotated bool
+	// syncLock serializes the syncs.
+	syncLock sync.Mutex
+	// synced is the number of appends made durable.
+	synced uint64
+}
+
+// openStore opens the store in the given directory, creating it if needed
+func openStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &store{dir: dir, wal: wal}, nil
+}
+
+// load returns the metadata of the snapshot with the logs replayed on top of it.
+// A record cut short by a crash is truncated from the log, so that the next
+// records are not appended to it.
+func (st *store) load() (ClusterMetadata, error) {
+	metadata := make(ClusterMetadata)
+	data, err := ioutil.ReadFile(filepath.Join(st.dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	// the old log of a snapshot that did not complete
+	old, err := ioutil.ReadFile(filepath.Join(st.dir, oldWALFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	replay(metadata, old)
+
+	if _, err := st.wal.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	log, err := ioutil.ReadAll(st.wal)
+	if err != nil {
+		return nil, err
+	}
+	if valid := replay(metadata, log); valid < len(log) {
+		if err := st.wal.Truncate(int64(valid)); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
+// replay applies the records of a log to the metadata, and returns
+// the length of the log up to the first record cut short by a crash
+func replay(metadata ClusterMetadata, log []byte) int {
+	valid := 0
+	for valid < len(log) {
+		end := bytes.IndexByte(log[valid:], '\n')
+		if end < 0 {
+			// the last record was cut short by a crash
+			break
+		}
+		var record walRecord
+		if err := json.Unmarshal(log[valid:valid+end], &record); err != nil || record.Value == nil {
+			break
+		}
+		if metadata[record.Node] == nil {
+			metadata[record.Node] = make(NodeState)
+		}
+		if old, ok := metadata[record.Node][record.Key]; !ok || record.Value.Version.After(old.Version) {
+			metadata[record.Node][record.Key] = record.Value
+		}
+		valid += end + 1
+	}
+	return valid
+}
+
+// append appends a local write to the log, without waiting for the disk.
+// If durable is true, the write is synced by the next call to sync, while
+// the other writes are only synced along with the durable ones.
+func (st *store) append(node string, key string, v *VersionedStr, durable bool) error {
+	data, err := json.Marshal(walRecord{Node: node, Key: key, Value: v})
+	if err != nil {
+		return err
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if _, err := st.wal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if durable {
+		st.appended++
+	}
+	return nil
+}
+
+// sync waits until the durable writes appended before it are on disk. The
+// concurrent syncs are batched, a sync returns at once if a previous one
+// already covered its writes.
+func (st *store) sync() error {
+	st.syncLock.Lock()
+	defer st.syncLock.Unlock()
+	st.lock.Lock()
+	wal, old, appended, rotated := st.wal, st.old, st.appended, st.rotated
+	st.rotated = false
+	st.lock.Unlock()
+	if appended == st.synced && !rotated {
+		return nil
+	}
+	if old != nil {
+		if err := old.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		return err
+	}
+	if rotated {
+		if err := syncDir(st.dir); err != nil {
+			return err
+		}
+	}
+	st.synced = appended
+	return nil
+}
+
+// prepareSnapshot returns the encoded metadata to write to the next snapshot,
+// and starts a new log for the next writes. No write must be appended
+// until it returns, so that the old log only holds writes of the snapshot.
+func (st *store) prepareSnapshot(metadata ClusterMetadata) ([]byte, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.old != nil {
+		// the old log of a previous snapshot that failed
+		// is removed by this one, the current log is kept
+		return data, nil
+	}
+	if _, err := os.Stat(filepath.Join(st.dir, oldWALFile)); err == nil {
+		// the old log of a snapshot that did not complete is
+		// removed by this one, the current log is kept
+		return data, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(st.dir, walFile), filepath.Join(st.dir, oldWALFile)); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(st.dir, walFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		// keep appending to the current log
+		if rerr := os.Rename(filepath.Join(st.dir, oldWALFile), filepath.Join(st.dir, walFile)); rerr != nil {
+			return nil, rerr
+		}
+		return nil, err
+	}
+	st.old, st.wal, st.rotated = st.wal, wal, true
+	return data, nil
+}
+
+// snapshot writes the data returned by prepareSnapshot to the
+// snapshot, and removes the old log. It does not block the appends.
+func (st *store) snapshot(data []byte) error {
+	// write to a temporary file first, so that
+	// a crash never leaves a partial snapshot
+	tmp := filepath.Join(st.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(st.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(st.dir); err != nil {
+		return err
+	}
+
+	st.syncLock.Lock()
+	defer st.syncLock.Unlock()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if err := os.Remove(filepath.Join(st.dir, oldWALFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if st.old != nil {
+		old := st.old
+		st.old = nil
+		return old.Close()
+	}
+	return nil
+}
+
+// close closes the logs
+func (st *store) close() error {
+	st.syncLock.Lock()
+	defer st.syncLock.Unlock()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.old != nil {
+		st.old.Close()
+		st.old = nil
+	}
+	return st.wal.Close()
+}
+
+// syncDir syncs a directory, so that the files renamed
+// and created in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
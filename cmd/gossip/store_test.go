@@ -0,0 +1,179 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a1 := &VersionedStr{Version: Version{Time: 1, Node: "a"}, Value: "1"}
+	a2 := &VersionedStr{Version: Version{Time: 2, Node: "a"}, Value: "2"}
+	b1 := &VersionedStr{Version: Version{Time: 1, Node: "a"}, Deleted: true}
+	assert.NoError(t, st.append("a", "a", a1, true))
+	assert.NoError(t, st.sync())
+	data, err := st.prepareSnapshot(ClusterMetadata{"a": {"a": a1}, "b": {"b": b1}})
+	assert.NoError(t, err)
+	assert.NoError(t, st.snapshot(data))
+	assert.NoError(t, st.append("a", "a", a2, false))
+	// a write cut short by a crash
+	_, err = st.wal.Write([]byte(`{"node":"a","key":"c","val`))
+	assert.NoError(t, err)
+	assert.NoError(t, st.close())
+
+	st, err = openStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer st.close()
+	metadata, err := st.load()
+	assert.NoError(t, err)
+	assert.Equal(t, ClusterMetadata{"a": {"a": a2}, "b": {"b": b1}}, metadata)
+
+	// the torn record was truncated, the next records survive a restart
+	a3 := &VersionedStr{Version: Version{Time: 3, Node: "a"}, Value: "3"}
+	assert.NoError(t, st.append("a", "a", a3, true))
+	assert.NoError(t, st.close())
+	st, err = openStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer st.close()
+	metadata, err = st.load()
+	assert.NoError(t, err)
+	assert.Equal(t, ClusterMetadata{"a": {"a": a3}, "b": {"b": b1}}, metadata)
+}
+
+func TestStoreInterruptedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a1 := &VersionedStr{Version: Version{Time: 1, Node: "a"}, Value: "1"}
+	b1 := &VersionedStr{Version: Version{Time: 1, Node: "a"}, Value: "1"}
+	b2 := &VersionedStr{Version: Version{Time: 2, Node: "a"}, Value: "2"}
+	assert.NoError(t, st.append("a", "a", a1, true))
+	assert.NoError(t, st.append("a", "b", b1, true))
+	_, err = st.prepareSnapshot(ClusterMetadata{"a": {"a": a1, "b": b1}})
+	assert.NoError(t, err)
+	// the writes during the snapshot go to the new log
+	assert.NoError(t, st.append("a", "b", b2, true))
+	assert.NoError(t, st.sync())
+	// the node crashes before the snapshot is written
+	assert.NoError(t, st.close())
+
+	st, err = openStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	metadata, err := st.load()
+	assert.NoError(t, err)
+	assert.Equal(t, ClusterMetadata{"a": {"a": a1, "b": b2}}, metadata)
+
+	// the next snapshot removes the old log, and keeps the new one
+	data, err := st.prepareSnapshot(metadata)
+	assert.NoError(t, err)
+	assert.NoError(t, st.snapshot(data))
+	_, err = os.Stat(filepath.Join(dir, oldWALFile))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, st.close())
+
+	st, err = openStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer st.close()
+	metadata, err = st.load()
+	assert.NoError(t, err)
+	assert.Equal(t, ClusterMetadata{"a": {"a": a1, "b": b2}}, metadata)
+}
+
+func TestServerRestart(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	newServer := func(physical time.Time) *Server {
+		s := NewServer([]string{}, Config{DataDir: dir, Transport: NewMemoryNetwork().Transport()})
+		s.now = func() time.Time {
+			return physical
+		}
+		assert.NoError(t, s.listen("a"))
+		return s
+	}
+
+	// the first run crashes before any snapshot
+	s := newServer(now)
+	s.lock.Lock()
+	s.addLocalState("a", "a")
+	s.addLocalState("b", "b")
+	s.deleteLocalState("b")
+	before := s.metadata["a"]["b"].Version
+	s.lock.Unlock()
+
+	// the second run restarts with a clock that went backwards
+	s = newServer(now.Add(-time.Hour))
+	s.lock.Lock()
+	assert.Equal(t, "a", s.metadata["a"]["a"].Value)
+	assert.True(t, s.metadata["a"]["b"].Deleted)
+	s.addLocalState("b", "c")
+	assert.True(t, s.metadata["a"]["b"].Version.After(before))
+	s.lock.Unlock()
+
+	// a clean shutdown snapshots the state
+	s.closeStore()
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	s = newServer(now)
+	assert.Equal(t, "c", s.metadata["a"]["b"].Value)
+}
+
+func TestServerRestartTags(t *testing.T) {
+	dir := t.TempDir()
+	newServer := func(tags map[string]string) *Server {
+		s := NewServer([]string{}, Config{DataDir: dir, Tags: tags, Transport: NewMemoryNetwork().Transport()})
+		assert.NoError(t, s.listen("a"))
+		return s
+	}
+
+	s := newServer(map[string]string{"role": "db", "zone": "a"})
+	s.closeStore()
+
+	// the tags that are no longer configured are deleted
+	s = newServer(map[string]string{"zone": "b"})
+	defer s.closeStore()
+	assert.Equal(t, []Member{{ID: "a", Address: "a", Status: StatusAlive, Tags: map[string]string{"zone": "b"}}}, s.Members(Selector{}))
+	assert.True(t, s.metadata["a"][keyTagPrefix+"role"].Deleted)
+}
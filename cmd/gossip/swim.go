@@ -0,0 +1,368 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This file implements the SWIM membership protocol
+// (https://www.cs.cornell.edu/projects/Quicksilver/public_pdfs/SWIM.pdf)
+//
+// Every protocol period, the node pings a random member. If the member
+// does not answer in time, the node asks k other members to ping it on its
+// behalf (ping-req). If none of them gets an answer either, the member is
+// suspected. The suspicion is piggybacked on the outgoing messages, and
+// the member is declared dead if it does not refute it in time by
+// incrementing its incarnation number.
+
+const (
+	// retransmitMult is the multiplier of the number of times a
+	// membership update is piggybacked.
+	retransmitMult = 4
+	// maxPiggyback is the maximum number of membership updates per message.
+	maxPiggyback = 10
+)
+
+// memberState is the membership state of a remote node
+type memberState struct {
+	Member
+	// since is the time of the last status change.
+	since time.Time
+}
+
+// statusRank orders the statuses of a same incarnation
+var statusRank = map[NodeStatus]int{
+	StatusAlive:   0,
+	StatusSuspect: 1,
+	StatusDead:    2,
+	StatusLeft:    3,
+}
+
+// overrides returns true if the membership update a
+// takes precedence over the membership update b
+func overrides(a, b Member) bool {
+	if a.Incarnation != b.Incarnation {
+		return a.Incarnation > b.Incarnation
+	}
+	return statusRank[a.Status] > statusRank[b.Status]
+}
+
+// applyUpdates applies the given membership updates.
+// It must be called with the lock held.
+func (s *Server) applyUpdates(updates []Member, now time.Time) {
+	for _, update := range updates {
+		s.applyUpdate(update, now)
+	}
+}
+
+// applyUpdate applies a membership update.
+// It must be called with the lock held.
+func (s *Server) applyUpdate(update Member, now time.Time) {
+	if update.ID == s.id {
+		if !s.left && update.Status != StatusAlive && update.Incarnation >= s.incarnation {
+			// refute the suspicion
+			s.incarnation = update.Incarnation + 1
+			s.broadcasts.enqueue(s.self())
+		} else if !s.left && update.Status != StatusAlive {
+			// the suspicion was refuted already, but the sender missed
+			// it, such as across a partition, so the refutation is sent again
+			s.broadcasts.enqueue(s.self())
+		}
+		return
+	}
+	member, ok := s.membership[update.ID]
+	if !ok {
+		s.membership[update.ID] = &memberState{Member: update, since: now}
+		s.broadcasts.enqueue(update)
+		s.ringStale = true
+		return
+	}
+	if !overrides(update, member.Member) {
+		return
+	}
+	if update.Address == "" {
+		update.Address = member.Address
+	}
+	if update.Status == StatusLeft {
+		s.logger.Info("member left", "member", update.ID)
+	}
+	member.Member = update
+	member.since = now
+	s.broadcasts.enqueue(update)
+	s.ringStale = true
+}
+
+// suspect marks the given member as suspect.
+// It must be called with the lock held.
+func (s *Server) suspect(id string, now time.Time) {
+	member, ok := s.membership[id]
+	if !ok || member.Status != StatusAlive {
+		return
+	}
+	s.logger.Info("suspecting member", "member", id)
+	update := member.Member
+	update.Status = StatusSuspect
+	s.applyUpdate(update, now)
+}
+
+// reap suspects the members whose failure detector reports them
+// as failing, and declares dead the suspects that did not refute
+// the suspicion in time. It must be called with the lock held.
+func (s *Server) reap(now time.Time) {
+	for id, member := range s.membership {
+		switch member.Status {
+		case StatusAlive:
+			if d, ok := s.detectors[id]; ok && d.status(now) != StatusAlive {
+				s.suspect(id, now)
+			}
+		case StatusSuspect:
+			if now.Sub(member.since) >= s.config.SuspicionTimeout {
+				s.logger.Info("declaring member dead", "member", id)
+				update := member.Member
+				update.Status = StatusDead
+				s.applyUpdate(update, now)
+			}
+		}
+	}
+	s.updateRing()
+	s.elect()
+}
+
+// maxTransmits returns the number of times a membership update is piggybacked.
+// It must be called with the lock held.
+func (s *Server) maxTransmits() int {
+	return retransmitMult * int(math.Ceil(math.Log10(float64(len(s.membership)+2))))
+}
+
+// probe runs a protocol period
+func (s *Server) probe(ctx context.Context) {
+	s.lock.Lock()
+	if s.left {
+		s.lock.Unlock()
+		return
+	}
+	s.reap(s.now())
+	target := randomNode(s.rand, s.liveNodes())
+	s.lock.Unlock()
+	if target == "" {
+		return
+	}
+
+	if err := s.ping(ctx, target); err == nil {
+		return
+	}
+	if s.pingIndirect(ctx, target) {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, member := range s.membership {
+		if member.Address == target {
+			s.suspect(id, s.now())
+		}
+	}
+}
+
+// ping sends a ping to the given node and waits for its ack
+func (s *Server) ping(ctx context.Context, node string) error {
+	ctx, cancel := s.withTimeout(ctx, s.config.ProbeTimeout)
+	defer cancel()
+
+	s.lock.Lock()
+	ping := s.newMessage(MessagePing)
+	s.lock.Unlock()
+
+	ack, err := s.send(ctx, node, ping)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.receive(ack, s.now())
+	return nil
+}
+
+// pingIndirect asks random members to ping the given node on our behalf,
+// and returns true if any of them received an ack
+func (s *Server) pingIndirect(ctx context.Context, node string) bool {
+	ctx, cancel := s.withTimeout(ctx, 2*s.config.ProbeTimeout)
+	defer cancel()
+
+	s.lock.Lock()
+	var candidates []string
+	for _, addr := range s.liveNodes() {
+		if addr != node {
+			candidates = append(candidates, addr)
+		}
+	}
+	relays := randomNodes(s.rand, candidates, s.config.IndirectChecks)
+	pingReq := s.newMessage(MessagePingReq)
+	pingReq.Target = node
+	s.lock.Unlock()
+	if len(relays) == 0 {
+		return false
+	}
+
+	if s.serial {
+		for _, relay := range relays {
+			if ack, err := s.send(ctx, relay, pingReq); err == nil {
+				s.lock.Lock()
+				s.receive(ack, s.now())
+				s.lock.Unlock()
+				return true
+			}
+		}
+		return false
+	}
+
+	acks := make(chan *Message, len(relays))
+	for _, relay := range relays {
+		go func(relay string) {
+			ack, err := s.send(ctx, relay, pingReq)
+			if err != nil {
+				ack = nil
+			}
+			acks <- ack
+		}(relay)
+	}
+	for range relays {
+		if ack := <-acks; ack != nil {
+			s.lock.Lock()
+			s.receive(ack, s.now())
+			s.lock.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// Leave announces that the local node leaves the cluster on purpose, so that
+// the other nodes stop contacting it at once instead of suspecting it. The
+// node stops gossiping and probing, and a node restarting with the same
+// address rejoins by refuting its departure. Start calls it when its context
+// is cancelled.
+func (s *Server) Leave(ctx context.Context) {
+	s.lock.Lock()
+	if s.left {
+		s.lock.Unlock()
+		return
+	}
+	s.left = true
+	s.incarnation++
+	s.ringStale = true
+	s.updateRing()
+	s.elect()
+	leave := &Message{
+		Type:    MessagePing,
+		From:    s.id,
+		Members: []Member{s.self()},
+	}
+	// the departure is sent to as many members as a piggybacked update
+	nodes := randomNodes(s.rand, s.liveNodes(), s.maxTransmits())
+	s.lock.Unlock()
+	s.logger.Info("leaving the cluster", "members", len(nodes))
+
+	if s.serial {
+		for _, node := range nodes {
+			s.announceLeave(ctx, node, leave)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			s.announceLeave(ctx, node, leave)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// announceLeave sends the departure of the local node to the given node
+func (s *Server) announceLeave(ctx context.Context, node string, leave *Message) {
+	if _, err := s.send(ctx, node, leave); err != nil {
+		s.logger.Warn("error announcing leave", "peer", node, "error", err)
+	}
+}
+
+// broadcast is a membership update waiting to be piggybacked
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// broadcastQueue holds the membership updates to disseminate. Each update
+// is piggybacked on a limited number of messages, the least transmitted first.
+type broadcastQueue struct {
+	updates map[string]*broadcast
+}
+
+// newBroadcastQueue creates a new broadcastQueue
+func newBroadcastQueue() *broadcastQueue {
+	return &broadcastQueue{
+		updates: make(map[string]*broadcast),
+	}
+}
+
+// enqueue adds an update to the queue, replacing
+// any pending update about the same node
+func (q *broadcastQueue) enqueue(member Member) {
+	q.updates[member.ID] = &broadcast{member: member}
+}
+
+// take returns up to limit updates to piggyback on a message.
+// Updates transmitted maxTransmits times are removed from the queue.
+func (q *broadcastQueue) take(limit int, maxTransmits int) []Member {
+	pending := make([]*broadcast, 0, len(q.updates))
+	for _, b := range q.updates {
+		pending = append(pending, b)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].transmits != pending[j].transmits {
+			return pending[i].transmits < pending[j].transmits
+		}
+		return pending[i].member.ID < pending[j].member.ID
+	})
+	var result []Member
+	for _, b := range pending {
+		if len(result) == limit {
+			break
+		}
+		result = append(result, b.member)
+		b.transmits++
+		if b.transmits >= maxTransmits {
+			delete(q.updates, b.member.ID)
+		}
+	}
+	return result
+}
@@ -0,0 +1,262 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// crashTransport is an http transport that stops sending messages once
+// crashed, so that the node cannot announce its departure
+type crashTransport struct {
+	*HTTPTransport
+	crashed int32
+}
+
+// crash makes the transport fail to send messages
+func (t *crashTransport) crash() {
+	atomic.StoreInt32(&t.crashed, 1)
+}
+
+// Send sends the message unless the transport crashed
+func (t *crashTransport) Send(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	if atomic.LoadInt32(&t.crashed) == 1 {
+		return nil, errors.New("crashed")
+	}
+	return t.HTTPTransport.Send(ctx, addr, msg)
+}
+
+func Test_overrides(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      Member
+		b      Member
+		expect bool
+	}{
+		{
+			name:   "higher incarnation",
+			a:      Member{Status: StatusAlive, Incarnation: 2},
+			b:      Member{Status: StatusSuspect, Incarnation: 1},
+			expect: true,
+		}, {
+			name:   "lower incarnation",
+			a:      Member{Status: StatusDead, Incarnation: 0},
+			b:      Member{Status: StatusAlive, Incarnation: 1},
+			expect: false,
+		}, {
+			name:   "suspect overrides alive",
+			a:      Member{Status: StatusSuspect, Incarnation: 1},
+			b:      Member{Status: StatusAlive, Incarnation: 1},
+			expect: true,
+		}, {
+			name:   "alive does not override suspect",
+			a:      Member{Status: StatusAlive, Incarnation: 1},
+			b:      Member{Status: StatusSuspect, Incarnation: 1},
+			expect: false,
+		}, {
+			name:   "dead overrides suspect",
+			a:      Member{Status: StatusDead, Incarnation: 1},
+			b:      Member{Status: StatusSuspect, Incarnation: 1},
+			expect: true,
+		}, {
+			name:   "left overrides dead",
+			a:      Member{Status: StatusLeft, Incarnation: 1},
+			b:      Member{Status: StatusDead, Incarnation: 1},
+			expect: true,
+		}, {
+			name:   "rejoin overrides left",
+			a:      Member{Status: StatusAlive, Incarnation: 2},
+			b:      Member{Status: StatusLeft, Incarnation: 1},
+			expect: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, overrides(tt.a, tt.b))
+		})
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.applyUpdate(Member{ID: "a", Status: StatusSuspect, Incarnation: 0}, time.Now())
+	assert.Equal(t, 1, s.incarnation)
+	assert.Equal(t, []Member{s.self()}, s.broadcasts.take(maxPiggyback, 1))
+
+	// stale suspicions do not increment the incarnation,
+	// but the refutation is sent again
+	s.applyUpdate(Member{ID: "a", Status: StatusSuspect, Incarnation: 0}, time.Now())
+	assert.Equal(t, 1, s.incarnation)
+	assert.Equal(t, []Member{s.self()}, s.broadcasts.take(maxPiggyback, 1))
+}
+
+func TestSuspicionTimeout(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	now := time.Now()
+	s.applyUpdate(Member{ID: "b", Address: "b", Status: StatusAlive}, now)
+	s.suspect("b", now)
+	assert.Equal(t, StatusSuspect, s.membership["b"].Status)
+
+	s.reap(now.Add(s.config.SuspicionTimeout / 2))
+	assert.Equal(t, StatusSuspect, s.membership["b"].Status)
+	assert.Equal(t, []string{"b"}, s.liveNodes())
+
+	s.reap(now.Add(s.config.SuspicionTimeout))
+	assert.Equal(t, StatusDead, s.membership["b"].Status)
+	assert.Empty(t, s.liveNodes())
+
+	// the node comes back with a higher incarnation
+	s.applyUpdate(Member{ID: "b", Status: StatusAlive, Incarnation: 1}, now)
+	assert.Equal(t, StatusAlive, s.membership["b"].Status)
+	assert.Equal(t, "b", s.membership["b"].Address)
+}
+
+func TestLeave(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	now := time.Now()
+	s.applyUpdate(Member{ID: "b", Address: "b", Status: StatusAlive}, now)
+	assert.Equal(t, []string{"b"}, s.liveNodes())
+
+	s.applyUpdate(Member{ID: "b", Status: StatusLeft, Incarnation: 1}, now)
+	assert.Equal(t, StatusLeft, s.membership["b"].Status)
+	assert.Empty(t, s.liveNodes())
+
+	// the node is not suspected after it left
+	s.reap(now.Add(time.Hour))
+	assert.Equal(t, StatusLeft, s.membership["b"].Status)
+
+	// the node restarts and refutes its departure
+	s.applyUpdate(Member{ID: "b", Status: StatusAlive, Incarnation: 2}, now)
+	assert.Equal(t, []string{"b"}, s.liveNodes())
+}
+
+func TestRejoin(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.applyUpdate(Member{ID: "a", Status: StatusLeft, Incarnation: 3}, time.Now())
+	assert.Equal(t, 4, s.incarnation)
+	assert.Equal(t, StatusAlive, s.self().Status)
+}
+
+func TestBroadcastQueue(t *testing.T) {
+	q := newBroadcastQueue()
+	q.enqueue(Member{ID: "a", Status: StatusAlive})
+	q.enqueue(Member{ID: "b", Status: StatusAlive})
+	q.enqueue(Member{ID: "b", Status: StatusSuspect})
+
+	assert.Equal(t, []Member{{ID: "a", Status: StatusAlive}}, q.take(1, 2))
+	assert.Equal(t, []Member{
+		{ID: "b", Status: StatusSuspect},
+		{ID: "a", Status: StatusAlive},
+	}, q.take(2, 2))
+	assert.Equal(t, []Member{{ID: "b", Status: StatusSuspect}}, q.take(2, 2))
+	assert.Empty(t, q.take(2, 2))
+}
+
+func TestFailureDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx1, stop1 := context.WithCancel(ctx)
+	defer stop1()
+
+	config := Config{
+		Interval:         100 * time.Millisecond,
+		ProbeInterval:    100 * time.Millisecond,
+		ProbeTimeout:     50 * time.Millisecond,
+		SuspicionTimeout: time.Second,
+	}
+	transport := &crashTransport{HTTPTransport: NewHTTPTransport()}
+	config1 := config
+	config1.Transport = transport
+	errs := make(chan error, 3)
+	addr1 := startServer(t, ctx1, NewServer([]string{}, config1), errs)
+	s2 := NewServer([]string{addr1}, config)
+	s3 := NewServer([]string{addr1}, config)
+	addr2 := startServer(t, ctx, s2, errs)
+	addr3 := startServer(t, ctx, s3, errs)
+
+	assert.Eventually(t, func() bool {
+		return hasAliveMember(s2, addr1) && hasAliveMember(s2, addr3) &&
+			hasAliveMember(s3, addr1) && hasAliveMember(s3, addr2)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	transport.crash()
+	stop1()
+	assert.NoError(t, <-errs)
+
+	isDead := func(s *Server, id string) bool {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		member, ok := s.membership[id]
+		return ok && member.Status == StatusDead
+	}
+	assert.Eventually(t, func() bool {
+		return isDead(s2, addr1) && isDead(s3, addr1)
+	}, 3*config.SuspicionTimeout, 100*time.Millisecond)
+	assert.True(t, hasAliveMember(s2, addr3))
+	assert.True(t, hasAliveMember(s3, addr2))
+
+	cancel()
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+}
+
+func TestGracefulLeave(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx1, stop1 := context.WithCancel(ctx)
+	defer stop1()
+
+	config := Config{
+		Interval:         100 * time.Millisecond,
+		ProbeInterval:    100 * time.Millisecond,
+		ProbeTimeout:     50 * time.Millisecond,
+		SuspicionTimeout: time.Minute,
+	}
+	s1 := NewServer([]string{}, config)
+	errs := make(chan error, 2)
+	addr1 := startServer(t, ctx1, s1, errs)
+	s2 := NewServer([]string{addr1}, config)
+	addr2 := startServer(t, ctx, s2, errs)
+
+	assert.Eventually(t, func() bool {
+		return hasAliveMember(s2, addr1) && hasAliveMember(s1, addr2)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// the departure is known before the node stops, long before it could be suspected
+	stop1()
+	assert.NoError(t, <-errs)
+	s2.lock.RLock()
+	assert.Equal(t, StatusLeft, s2.membership[addr1].Status)
+	assert.Empty(t, s2.liveNodes())
+	s2.lock.RUnlock()
+
+	cancel()
+	assert.NoError(t, <-errs)
+}
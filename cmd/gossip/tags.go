@@ -0,0 +1,190 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// keyTagPrefix is the prefix of the keys holding the tags of a node.
+// It is reserved like the other keys of the protocol, so the tags
+// cannot be written through the API.
+const keyTagPrefix = "gossip_tag_"
+
+// requirement is a term of a selector
+type requirement struct {
+	key    string
+	value  string
+	negate bool
+	// exists only checks the presence of the tag
+	exists bool
+}
+
+// matches returns true if the tags satisfy the requirement
+func (r requirement) matches(tags map[string]string) bool {
+	value, ok := tags[r.key]
+	if r.exists {
+		return ok != r.negate
+	}
+	return (ok && value == r.value) != r.negate
+}
+
+// Selector selects nodes by their tags
+type Selector struct {
+	requirements []requirement
+}
+
+// ParseSelector parses a comma separated list of requirements, that
+// the tags of a node must all satisfy to be selected:
+//   - key=value: the tag is set to the value
+//   - key!=value: the tag is not set to the value, or not set at all
+//   - key: the tag is set
+//   - !key: the tag is not set
+//
+// The empty selector selects every node.
+func ParseSelector(selector string) (Selector, error) {
+	var result Selector
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r requirement
+		if i := strings.Index(term, "!="); i >= 0 {
+			r = requirement{key: term[:i], value: term[i+2:], negate: true}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			r = requirement{key: term[:i], value: term[i+1:]}
+		} else if strings.HasPrefix(term, "!") {
+			r = requirement{key: term[1:], negate: true, exists: true}
+		} else {
+			r = requirement{key: term, exists: true}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if err := validateTag(r.key); err != nil {
+			return Selector{}, fmt.Errorf("invalid selector %q: %w", term, err)
+		}
+		result.requirements = append(result.requirements, r)
+	}
+	return result, nil
+}
+
+// Matches returns true if the tags satisfy all the requirements of the selector
+func (s Selector) Matches(tags map[string]string) bool {
+	for _, r := range s.requirements {
+		if !r.matches(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selector in the format of ParseSelector
+func (s Selector) String() string {
+	terms := make([]string, len(s.requirements))
+	for i, r := range s.requirements {
+		switch {
+		case r.exists && r.negate:
+			terms[i] = "!" + r.key
+		case r.exists:
+			terms[i] = r.key
+		case r.negate:
+			terms[i] = r.key + "!=" + r.value
+		default:
+			terms[i] = r.key + "=" + r.value
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// validateTag returns an error if the name cannot be used in a selector
+func validateTag(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty tag name")
+	}
+	if strings.ContainsAny(name, "=!, ") {
+		return fmt.Errorf("tag name %q contains one of '=', '!', ',' or ' '", name)
+	}
+	return nil
+}
+
+// tags returns the tags of a node, read from its state
+func tags(state NodeState) map[string]string {
+	var result map[string]string
+	for key, value := range state {
+		if !strings.HasPrefix(key, keyTagPrefix) || value.Deleted {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]string)
+		}
+		result[strings.TrimPrefix(key, keyTagPrefix)] = value.Value
+	}
+	return result
+}
+
+// setTags writes the tags of the local node, and deletes the ones it had
+// before, such as in a restored state. It must be called with the lock held.
+func (s *Server) setTags(tags map[string]string) {
+	var stale []string
+	for key := range s.metadata[s.id] {
+		if name := strings.TrimPrefix(key, keyTagPrefix); name != key {
+			if _, ok := tags[name]; !ok {
+				stale = append(stale, key)
+			}
+		}
+	}
+	sort.Strings(stale)
+	for _, key := range stale {
+		s.deleteLocalState(key)
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.addLocalState(keyTagPrefix+name, tags[name])
+	}
+}
+
+// Members returns the live members of the cluster whose tags
+// match the selector, the local node included, sorted by id
+func (s *Server) Members(selector Selector) []Member {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := []Member{}
+	for _, member := range s.members() {
+		if member.Status == StatusDead || member.Status == StatusLeft {
+			continue
+		}
+		if selector.Matches(member.Tags) {
+			result = append(result, member)
+		}
+	}
+	return result
+}
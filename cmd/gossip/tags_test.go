@@ -0,0 +1,126 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		tags     map[string]string
+		expect   bool
+	}{
+		{selector: "", tags: nil, expect: true},
+		{selector: "role=db", tags: map[string]string{"role": "db"}, expect: true},
+		{selector: "role=db", tags: map[string]string{"role": "web"}, expect: false},
+		{selector: "role=db", tags: nil, expect: false},
+		{selector: "zone!=a", tags: map[string]string{"zone": "b"}, expect: true},
+		{selector: "zone!=a", tags: map[string]string{"zone": "a"}, expect: false},
+		{selector: "zone!=a", tags: nil, expect: true},
+		{selector: "role=db, zone!=a", tags: map[string]string{"role": "db", "zone": "b"}, expect: true},
+		{selector: "role=db,zone!=a", tags: map[string]string{"role": "db", "zone": "a"}, expect: false},
+		{selector: "version", tags: map[string]string{"version": "1"}, expect: true},
+		{selector: "version", tags: nil, expect: false},
+		{selector: "!version", tags: nil, expect: true},
+		{selector: "!version", tags: map[string]string{"version": "1"}, expect: false},
+		{selector: "role=", tags: map[string]string{"role": ""}, expect: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := ParseSelector(tt.selector)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, selector.Matches(tt.tags))
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector(" role=db,zone!=a,version,!canary ")
+	assert.NoError(t, err)
+	assert.Equal(t, "role=db,zone!=a,version,!canary", selector.String())
+
+	for _, invalid := range []string{"=db", "!=a", "!", "a b=c"} {
+		_, err := ParseSelector(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMembers(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.setTags(map[string]string{"role": "web"})
+	now := time.Now()
+	for _, id := range []string{"b", "c", "d"} {
+		s.applyUpdate(Member{ID: id, Address: id, Status: StatusAlive}, now)
+	}
+	s.metadata["b"] = NodeState{keyTagPrefix + "role": {Value: "db"}}
+	s.metadata["c"] = NodeState{keyTagPrefix + "role": {Value: "db"}}
+	s.metadata["d"] = NodeState{keyTagPrefix + "role": {Value: "db", Deleted: true}}
+	s.applyUpdate(Member{ID: "c", Status: StatusDead, Incarnation: 1}, now)
+
+	selector, err := ParseSelector("role=db")
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{
+		{ID: "b", Address: "b", Status: StatusAlive, Tags: map[string]string{"role": "db"}},
+	}, s.Members(selector))
+
+	selector, err = ParseSelector("role!=db")
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{
+		{ID: "a", Address: "a", Status: StatusAlive, Tags: map[string]string{"role": "web"}},
+		{ID: "d", Address: "d", Status: StatusAlive},
+	}, s.Members(selector))
+}
+
+func TestTagsAreReserved(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	s.setTags(map[string]string{"role": "web"})
+
+	// the tags can only be changed by the configuration of the node
+	for _, req := range []struct{ method, path, body string }{
+		{http.MethodPost, "/", `{"gossip_tag_role":"db"}`},
+		{http.MethodPost, "/", `{"gossip_tag_zone":"a"}`},
+		{http.MethodDelete, "/", `["gossip_tag_role"]`},
+		{http.MethodPost, "/crdt/set", `{"key":"gossip_tag_weight","value":"100"}`},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+		r.Header.Set("Content-Type", "application/json")
+		s.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, req.body)
+	}
+
+	selector, err := ParseSelector("")
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{
+		{ID: "a", Address: "a", Status: StatusAlive, Tags: map[string]string{"role": "web"}},
+	}, s.Members(selector))
+}
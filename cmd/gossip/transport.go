@@ -0,0 +1,82 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Handler handles a message received from another node,
+// and returns the response to send back.
+type Handler func(ctx context.Context, msg *Message) (*Message, error)
+
+// Transport carries the messages between gossip nodes.
+type Transport interface {
+	// Listen starts receiving messages on the given address,
+	// and passes them to the handler.
+	Listen(addr string, handler Handler) error
+	// Addr returns the address the transport listens on.
+	Addr() string
+	// Send sends a message to the node at the given address,
+	// and returns its response.
+	Send(ctx context.Context, addr string, msg *Message) (*Message, error)
+	// Close stops receiving messages.
+	Close() error
+}
+
+// apiTransport is implemented by the transports that
+// can also serve the HTTP API on their address
+type apiTransport interface {
+	serveAPI(api http.Handler)
+}
+
+// rejectingTransport is implemented by the transports
+// that reject connections on their own, such as with TLS
+type rejectingTransport interface {
+	onReject(reject func(error))
+}
+
+// countingTransport is implemented by the transports
+// that count the bytes of the messages they exchange
+type countingTransport interface {
+	onTraffic(count func(sent int, received int))
+}
+
+// NewTransport returns a new transport of the given kind,
+// one of http, tcp or udp
+func NewTransport(kind string) (Transport, error) {
+	switch kind {
+	case "http":
+		return NewHTTPTransport(), nil
+	case "tcp":
+		return NewTCPTransport(), nil
+	case "udp":
+		return NewUDPTransport(), nil
+	default:
+		return nil, fmt.Errorf("invalid transport %q", kind)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransports(t *testing.T) {
+	network := NewMemoryNetwork()
+	tests := []struct {
+		name      string
+		transport func() Transport
+		addr      string
+	}{
+		{
+			name:      "http",
+			transport: func() Transport { return NewHTTPTransport() },
+			addr:      "127.0.0.1:0",
+		}, {
+			name:      "tcp",
+			transport: func() Transport { return NewTCPTransport() },
+			addr:      "127.0.0.1:0",
+		}, {
+			name:      "udp",
+			transport: func() Transport { return NewUDPTransport() },
+			addr:      "127.0.0.1:0",
+		}, {
+			name:      "memory",
+			transport: func() Transport { return network.Transport() },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			server := tt.transport()
+			err := server.Listen(tt.addr, func(ctx context.Context, msg *Message) (*Message, error) {
+				if msg.Type == MessagePingReq {
+					return nil, errors.New("no ack from " + msg.Target)
+				}
+				return &Message{Type: MessageAck, From: "server", Members: msg.Members}, nil
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer server.Close()
+			client := tt.transport()
+
+			members := []Member{{ID: "a", Address: "a", Status: StatusSuspect, Incarnation: 2}}
+			ack, err := client.Send(ctx, server.Addr(), &Message{Type: MessagePing, From: "client", Members: members})
+			assert.NoError(t, err)
+			assert.Equal(t, &Message{Type: MessageAck, From: "server", Members: members}, ack)
+
+			_, err = client.Send(ctx, server.Addr(), &Message{Type: MessagePingReq, From: "client", Target: "b"})
+			assert.ErrorContains(t, err, "no ack from b")
+		})
+	}
+}
+
+func TestTransportsRecover(t *testing.T) {
+	for name, transport := range map[string]func() Transport{
+		"tcp": func() Transport { return NewTCPTransport() },
+		"udp": func() Transport { return NewUDPTransport() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server := transport()
+			assert.NoError(t, server.Listen("127.0.0.1:0", func(ctx context.Context, msg *Message) (*Message, error) {
+				var state NodeState
+				return &Message{From: state["a"].Value}, nil
+			}))
+			defer server.Close()
+
+			_, err := transport().Send(ctx, server.Addr(), &Message{Type: MessagePing})
+			assert.ErrorContains(t, err, "error handling message")
+		})
+	}
+}
+
+func TestHandleRecover(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	// a message that used to crash the node
+	var msg Message
+	assert.NoError(t, json.Unmarshal([]byte(`{"type":"ping","from":"b","metadata":{"x":{"k":null}}}`), &msg))
+	_, err := s.handle(context.Background(), &msg)
+	assert.NoError(t, err)
+
+	s.membership = nil
+	_, err = s.handle(context.Background(), &Message{Type: MessagePing, From: "b", Members: []Member{{ID: "b"}}})
+	assert.ErrorContains(t, err, "error handling message")
+	assert.Equal(t, uint64(1), s.metrics.get(&s.metrics.receiveErrors))
+}
+
+func TestUDPTransportLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := NewUDPTransport()
+	oversized := make(chan error, 2)
+	server.limitSize(1024, func(err error) {
+		oversized <- err
+	})
+	large := &Message{Type: MessageAck, Metadata: ClusterMetadata{"a": NodeState{"a": {Value: strings.Repeat("a", maxDatagramSize)}}}}
+	assert.NoError(t, server.Listen("127.0.0.1:0", func(ctx context.Context, msg *Message) (*Message, error) {
+		if msg.Type == MessageSyn {
+			return large, nil
+		}
+		return &Message{Type: MessageAck}, nil
+	}))
+	defer server.Close()
+	client := NewUDPTransport()
+
+	// the messages larger than a datagram are not sent
+	_, err := client.Send(ctx, server.Addr(), large)
+	assert.ErrorIs(t, err, errTooLarge)
+
+	// the datagrams over the limit are refused
+	_, err = client.Send(ctx, server.Addr(), &Message{Type: MessagePing, From: strings.Repeat("a", 2048)})
+	assert.ErrorContains(t, err, "exceeds 1024 bytes")
+
+	// and so are the responses larger than a datagram
+	_, err = client.Send(ctx, server.Addr(), &Message{Type: MessageSyn})
+	assert.ErrorContains(t, err, "exceeds the size of a datagram")
+	assert.Len(t, oversized, 2)
+	assert.ErrorIs(t, <-oversized, errTooLarge)
+}
+
+func TestMemoryTransportClosed(t *testing.T) {
+	network := NewMemoryNetwork()
+	transport := network.Transport()
+	assert.NoError(t, transport.Listen("", func(ctx context.Context, msg *Message) (*Message, error) {
+		return msg, nil
+	}))
+	assert.Equal(t, "memory-1", transport.Addr())
+	assert.Error(t, network.Transport().Listen("memory-1", nil))
+	assert.NoError(t, transport.Close())
+
+	_, err := network.Transport().Send(context.Background(), "memory-1", &Message{Type: MessagePing})
+	assert.Error(t, err)
+}
+
+func TestGossipInMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := NewMemoryNetwork()
+	config := Config{
+		Interval:      50 * time.Millisecond,
+		ProbeInterval: 50 * time.Millisecond,
+		ProbeTimeout:  50 * time.Millisecond,
+	}
+	var servers []*Server
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		config.Transport = network.Transport()
+		s := NewServer([]string{"node-0"}, config)
+		servers = append(servers, s)
+		go func(addr string) {
+			errs <- s.Start(ctx, addr)
+		}(fmt.Sprintf("node-%d", i))
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, s := range servers {
+			s.lock.RLock()
+			n := len(s.liveNodes())
+			s.lock.RUnlock()
+			if n != len(servers)-1 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	cancel()
+	for range servers {
+		assert.NoError(t, <-errs)
+	}
+}
@@ -24,9 +24,89 @@
 
 package gossip
 
+import "time"
+
 type NodeState map[string]*VersionedStr
 type ClusterMetadata map[string]NodeState
 
+// Digest is the highest known version of the state of each node.
+// The versions of a node are assigned by the node itself and increase
+// with every write, so two nodes with the same version for a node have
+// the same state for it.
+type Digest map[string]Version
+
+// maxVersion returns the highest version of the NodeState,
+// or the zero Version if it is empty
+func (n NodeState) maxVersion() Version {
+	var max Version
+	for _, v := range n {
+		if v.Version.After(max) {
+			max = v.Version
+		}
+	}
+	return max
+}
+
+// digest returns the digest of the ClusterMetadata
+func digest(metadata ClusterMetadata) Digest {
+	result := make(Digest)
+	for nodeId, state := range metadata {
+		result[nodeId] = state.maxVersion()
+	}
+	return result
+}
+
+// stateSince returns copies of the entries of the NodeState newer than
+// the given version, so that they can be sent without holding the lock
+func stateSince(state NodeState, version Version) NodeState {
+	result := make(NodeState)
+	for k, v := range state {
+		if v.Version.After(version) {
+			c := *v
+			result[k] = &c
+		}
+	}
+	return result
+}
+
+// deltaSince returns the entries of the ClusterMetadata that are
+// newer than the given digest. Nodes missing from the digest are
+// returned entirely.
+func deltaSince(metadata ClusterMetadata, d Digest) ClusterMetadata {
+	result := make(ClusterMetadata)
+	for nodeId, state := range metadata {
+		if s := stateSince(state, d[nodeId]); len(s) > 0 {
+			result[nodeId] = s
+		}
+	}
+	return result
+}
+
+// requested returns the entries of the ClusterMetadata that are
+// newer than the given digest, only for the nodes of the digest
+func requested(metadata ClusterMetadata, d Digest) ClusterMetadata {
+	result := make(ClusterMetadata)
+	for nodeId, version := range d {
+		if s := stateSince(metadata[nodeId], version); len(s) > 0 {
+			result[nodeId] = s
+		}
+	}
+	return result
+}
+
+// outdated returns the digest of the nodes for which the given
+// digest is newer than the ClusterMetadata, with our own versions
+func outdated(metadata ClusterMetadata, d Digest) Digest {
+	result := make(Digest)
+	for nodeId, version := range d {
+		local := metadata[nodeId].maxVersion()
+		if version.After(local) {
+			result[nodeId] = local
+		}
+	}
+	return result
+}
+
 // delta returns the delta between two ClusterMetadata
 func delta(from ClusterMetadata, to ClusterMetadata) ClusterMetadata {
 	diff := make(ClusterMetadata)
@@ -56,8 +136,11 @@ func diffState(from, to NodeState) NodeState {
 			continue
 		}
 		toValue := to[fKey]
-		if fValue.Version != toValue.Version || fValue.Value != toValue.Value {
-			if fValue.Version > toValue.Version {
+		if fValue.Version != toValue.Version || fValue.Value != toValue.Value || fValue.Deleted != toValue.Deleted {
+			if joined, ok := fValue.join(toValue); ok {
+				// CRDTs are joined rather than overwritten
+				diff[fKey] = joined
+			} else if fValue.newer(toValue) {
 				diff[fKey] = fValue
 			} else {
 				diff[fKey] = toValue
@@ -67,19 +150,68 @@ func diffState(from, to NodeState) NodeState {
 	return diff
 }
 
-// merge merges two ClusterMetadata
-func merge(to ClusterMetadata, from ClusterMetadata) {
+// merge merges two ClusterMetadata, and returns the changes. The entries
+// expired at the given time are ignored, so that stale nodes cannot bring
+// them back.
+func merge(to ClusterMetadata, from ClusterMetadata, now time.Time) []Event {
+	var events []Event
 	diff := delta(from, to)
 	for nodeId := range diff {
 		if _, ok := to[nodeId]; !ok {
-			to[nodeId] = diff[nodeId]
-		} else {
-			if _, ok := to[nodeId]; !ok {
-				to[nodeId] = make(NodeState)
+			to[nodeId] = make(NodeState)
+		}
+		for k, v := range diff[nodeId] {
+			old, ok := to[nodeId][k]
+			if (ok && old.equal(v)) || v.expired(now) {
+				continue
+			}
+			var oldVersion Version
+			if ok {
+				oldVersion = old.Version
 			}
-			for k, v := range diff[nodeId] {
-				to[nodeId][k] = v
+			to[nodeId][k] = v
+			events = append(events, newEvent(nodeId, k, oldVersion, v))
+		}
+	}
+	return events
+}
+
+// collectTombstones removes the tombstones deleted before the given time,
+// and returns the number of removed tombstones.
+//
+// A tombstone must be kept long enough to reach every node, otherwise a
+// node that missed it would keep the deleted value. Removing it does not
+// break the digests, since the heartbeat of the node that deleted the key
+// has a higher version than the tombstone anyway.
+func collectTombstones(metadata ClusterMetadata, before time.Time) int {
+	count := 0
+	for _, state := range metadata {
+		for k, v := range state {
+			if v.Deleted && v.Version.Time < before.UnixMilli() {
+				delete(state, k)
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// collectExpired removes the entries expired at the given time, and returns
+// the number of removed entries.
+//
+// Every node removes an expired entry on its own, at the time derived from
+// the version of the entry. As with the tombstones, removing it does not
+// break the digests, since the heartbeat of the node that wrote the entry
+// has a higher version anyway.
+func collectExpired(metadata ClusterMetadata, now time.Time) int {
+	count := 0
+	for _, state := range metadata {
+		for k, v := range state {
+			if v.expired(now) {
+				delete(state, k)
+				count++
 			}
 		}
 	}
+	return count
 }
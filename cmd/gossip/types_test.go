@@ -28,6 +28,7 @@ import (
 	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func Test_merge(t *testing.T) {
@@ -41,39 +42,56 @@ func Test_merge(t *testing.T) {
 			name: "different",
 			to: ClusterMetadata{
 				"b": NodeState{
-					"b": &VersionedStr{Version: 0, Value: "b"},
+					"b": &VersionedStr{Version: Version{Time: 0}, Value: "b"},
 				},
 			},
 			from: ClusterMetadata{
 				"a": NodeState{
-					"a": &VersionedStr{Version: 0, Value: "a"},
+					"a": &VersionedStr{Version: Version{Time: 0}, Value: "a"},
 				},
 			},
 			expect: ClusterMetadata{
 				"a": NodeState{
-					"a": &VersionedStr{Version: 0, Value: "a"},
+					"a": &VersionedStr{Version: Version{Time: 0}, Value: "a"},
 				},
 				"b": NodeState{
-					"b": &VersionedStr{Version: 0, Value: "b"},
+					"b": &VersionedStr{Version: Version{Time: 0}, Value: "b"},
 				},
 			},
 		}, {
 			name: "different version",
 			to: ClusterMetadata{
 				"a": NodeState{
-					"a": &VersionedStr{Version: 0, Value: "a"},
-					"b": &VersionedStr{Version: 0, Value: "b"},
+					"a": &VersionedStr{Version: Version{Time: 0}, Value: "a"},
+					"b": &VersionedStr{Version: Version{Time: 0}, Value: "b"},
 				},
 			},
 			from: ClusterMetadata{
 				"a": NodeState{
-					"a": &VersionedStr{Version: 1, Value: "a"},
+					"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
 				},
 			},
 			expect: ClusterMetadata{
 				"a": NodeState{
-					"a": &VersionedStr{Version: 1, Value: "a"},
-					"b": &VersionedStr{Version: 0, Value: "b"},
+					"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
+					"b": &VersionedStr{Version: Version{Time: 0}, Value: "b"},
+				},
+			},
+		}, {
+			name: "version tie",
+			to: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 1, Node: "b"}, Value: "b"},
+				},
+			},
+			from: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 1, Node: "a"}, Value: "a"},
+				},
+			},
+			expect: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 1, Node: "b"}, Value: "b"},
 				},
 			},
 		},
@@ -84,7 +102,7 @@ func Test_merge(t *testing.T) {
 			jsonBytes, _ := json.Marshal(tt.to)
 			t.Log(string(jsonBytes))
 
-			merge(tt.to, tt.from)
+			merge(tt.to, tt.from, time.Now())
 
 			jsonBytes, _ = json.Marshal(tt.to)
 			t.Log(string(jsonBytes))
@@ -93,3 +111,190 @@ func Test_merge(t *testing.T) {
 		})
 	}
 }
+
+func Test_deltaSince(t *testing.T) {
+	metadata := ClusterMetadata{
+		"a": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 0}, Value: "a"},
+			"b": &VersionedStr{Version: Version{Time: 2}, Value: "b"},
+		},
+		"b": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
+		},
+	}
+	assert.Equal(t, Digest{"a": {Time: 2}, "b": {Time: 1}}, digest(metadata))
+
+	tests := []struct {
+		name   string
+		digest Digest
+		expect ClusterMetadata
+	}{
+		{
+			name:   "up to date",
+			digest: Digest{"a": {Time: 2}, "b": {Time: 1}},
+			expect: ClusterMetadata{},
+		}, {
+			name:   "outdated",
+			digest: Digest{"a": {Time: 1}, "b": {Time: 1}},
+			expect: ClusterMetadata{
+				"a": NodeState{
+					"b": &VersionedStr{Version: Version{Time: 2}, Value: "b"},
+				},
+			},
+		}, {
+			name:   "unknown node",
+			digest: Digest{"a": {Time: 2}},
+			expect: ClusterMetadata{
+				"b": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, deltaSince(metadata, tt.digest))
+		})
+	}
+}
+
+func Test_outdated(t *testing.T) {
+	metadata := ClusterMetadata{
+		"a": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 3}, Value: "a"},
+		},
+		"b": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
+		},
+	}
+	remote := Digest{"a": {Time: 2}, "b": {Time: 4}, "c": {Time: 0, Counter: 1}}
+
+	missing := outdated(metadata, remote)
+	assert.Equal(t, Digest{"b": {Time: 1}, "c": {}}, missing)
+
+	// the remote node answers with the requested entries
+	assert.Equal(t, ClusterMetadata{
+		"b": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
+		},
+	}, requested(metadata, Digest{"b": {Time: 0}, "c": {}}))
+}
+
+func Test_mergeTombstones(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   ClusterMetadata
+		to     ClusterMetadata
+		expect ClusterMetadata
+	}{
+		{
+			name: "deleted",
+			to: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
+				},
+			},
+			from: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 2}, Deleted: true},
+				},
+			},
+			expect: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 2}, Deleted: true},
+				},
+			},
+		}, {
+			name: "stale value",
+			to: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 2}, Deleted: true},
+				},
+			},
+			from: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 1}, Value: "a"},
+				},
+			},
+			expect: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 2}, Deleted: true},
+				},
+			},
+		}, {
+			name: "set again",
+			to: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 2}, Deleted: true},
+				},
+			},
+			from: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 3}, Value: "b"},
+				},
+			},
+			expect: ClusterMetadata{
+				"a": NodeState{
+					"a": &VersionedStr{Version: Version{Time: 3}, Value: "b"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merge(tt.to, tt.from, time.Now())
+			assert.Equal(t, tt.expect, tt.to)
+		})
+	}
+}
+
+func Test_collectTombstones(t *testing.T) {
+	metadata := ClusterMetadata{
+		"a": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 1000}, Deleted: true},
+			"b": &VersionedStr{Version: Version{Time: 3000}, Deleted: true},
+			"c": &VersionedStr{Version: Version{Time: 1000}, Value: "c"},
+		},
+	}
+	assert.Equal(t, 1, collectTombstones(metadata, time.UnixMilli(2000)))
+	assert.Equal(t, ClusterMetadata{
+		"a": NodeState{
+			"b": &VersionedStr{Version: Version{Time: 3000}, Deleted: true},
+			"c": &VersionedStr{Version: Version{Time: 1000}, Value: "c"},
+		},
+	}, metadata)
+}
+
+func Test_collectExpired(t *testing.T) {
+	metadata := ClusterMetadata{
+		"a": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 1000}, Value: "a", Expires: 2000},
+			"b": &VersionedStr{Version: Version{Time: 1000}, Value: "b", Expires: 3000},
+			"c": &VersionedStr{Version: Version{Time: 1000}, Value: "c"},
+		},
+	}
+	assert.Equal(t, 1, collectExpired(metadata, time.UnixMilli(2000)))
+	assert.Equal(t, ClusterMetadata{
+		"a": NodeState{
+			"b": &VersionedStr{Version: Version{Time: 1000}, Value: "b", Expires: 3000},
+			"c": &VersionedStr{Version: Version{Time: 1000}, Value: "c"},
+		},
+	}, metadata)
+}
+
+func Test_mergeExpired(t *testing.T) {
+	to := ClusterMetadata{}
+	from := ClusterMetadata{
+		"a": NodeState{
+			"a": &VersionedStr{Version: Version{Time: 1000}, Value: "a", Expires: 2000},
+			"b": &VersionedStr{Version: Version{Time: 1000}, Value: "b", Expires: 3000},
+		},
+	}
+	events := merge(to, from, time.UnixMilli(2500))
+	assert.Len(t, events, 1)
+	assert.Equal(t, ClusterMetadata{
+		"a": NodeState{
+			"b": &VersionedStr{Version: Version{Time: 1000}, Value: "b", Expires: 3000},
+		},
+	}, to)
+}
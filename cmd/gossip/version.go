@@ -0,0 +1,147 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version orders the writes of the cluster.
+//
+// It is a hybrid logical clock timestamp: the physical time of the write,
+// plus a logical counter that orders the writes made within the same
+// millisecond, or after the clock observed a version from the future.
+// The id of the node that made the write breaks the remaining ties.
+type Version struct {
+	// Time is the physical part of the timestamp, in unix milliseconds.
+	Time int64 `json:"time"`
+	// Counter is the logical part of the timestamp.
+	Counter int `json:"counter"`
+	// Node is the id of the node that made the write.
+	Node string `json:"node"`
+}
+
+// Compare returns -1, 0 or 1 if the version is lower,
+// equal or higher than the other version
+func (v Version) Compare(other Version) int {
+	if v.Time != other.Time {
+		if v.Time < other.Time {
+			return -1
+		}
+		return 1
+	}
+	if v.Counter != other.Counter {
+		if v.Counter < other.Counter {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(v.Node, other.Node)
+}
+
+// After returns true if the version is higher than the other version
+func (v Version) After(other Version) bool {
+	return v.Compare(other) > 0
+}
+
+// Clock assigns the versions of the local writes.
+type Clock interface {
+	// Now returns a version higher than all the versions
+	// returned or observed before.
+	Now() Version
+	// Observe records a version received from another node.
+	// It returns an error if the version is too far in the future.
+	Observe(v Version) error
+}
+
+// hlc is a hybrid logical clock
+// (https://cse.buffalo.edu/tech-reports/2014-04.pdf)
+//
+// Since its versions follow the physical time, a restarted node
+// keeps writing versions higher than the ones it wrote before.
+type hlc struct {
+	// node is the id of the local node.
+	node string
+	// physical returns the physical time.
+	physical func() time.Time
+	// maxOffset is how far ahead of the physical time the observed
+	// versions can be, so that a peer with a wrong clock cannot push
+	// the versions of the node far into the future.
+	maxOffset time.Duration
+	// last is the last version returned or observed.
+	last Version
+	lock sync.Mutex
+}
+
+var _ Clock = &hlc{}
+
+// newHLC creates a new hybrid logical clock for the given node, ignoring the
+// observed versions more than maxOffset ahead of the physical time
+func newHLC(node string, physical func() time.Time, maxOffset time.Duration) *hlc {
+	return &hlc{
+		node:      node,
+		physical:  physical,
+		maxOffset: maxOffset,
+	}
+}
+
+// Now returns a version higher than all the versions returned or observed before
+func (c *hlc) Now() Version {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pt := c.physical().UnixMilli()
+	if pt > c.last.Time {
+		c.last.Time = pt
+		c.last.Counter = 0
+	} else {
+		c.last.Counter++
+	}
+	return Version{
+		Time:    c.last.Time,
+		Counter: c.last.Counter,
+		Node:    c.node,
+	}
+}
+
+// Observe records a version received from another node, so that
+// the next versions are higher than it. The versions of other nodes more
+// than maxOffset ahead of the physical time are rejected, while the ones
+// of the node itself are kept, such as when its clock went backwards
+// since they were written.
+func (c *hlc) Observe(v Version) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if limit := c.physical().Add(c.maxOffset).UnixMilli(); v.Node != c.node && v.Time > limit {
+		return fmt.Errorf("version %d is %dms ahead of the maximum clock offset", v.Time, v.Time-limit)
+	}
+	if v.Time > c.last.Time || (v.Time == c.last.Time && v.Counter > c.last.Counter) {
+		c.last.Time = v.Time
+		c.last.Counter = v.Counter
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      Version
+		b      Version
+		expect int
+	}{
+		{
+			name:   "time",
+			a:      Version{Time: 2, Counter: 0, Node: "a"},
+			b:      Version{Time: 1, Counter: 5, Node: "b"},
+			expect: 1,
+		}, {
+			name:   "counter",
+			a:      Version{Time: 1, Counter: 0, Node: "b"},
+			b:      Version{Time: 1, Counter: 1, Node: "a"},
+			expect: -1,
+		}, {
+			name:   "node",
+			a:      Version{Time: 1, Counter: 1, Node: "b"},
+			b:      Version{Time: 1, Counter: 1, Node: "a"},
+			expect: 1,
+		}, {
+			name:   "equal",
+			a:      Version{Time: 1, Counter: 1, Node: "a"},
+			b:      Version{Time: 1, Counter: 1, Node: "a"},
+			expect: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, tt.a.Compare(tt.b))
+		})
+	}
+}
+
+func TestHLC(t *testing.T) {
+	now := time.UnixMilli(1000)
+	c := newHLC("a", func() time.Time {
+		return now
+	}, time.Minute)
+
+	assert.Equal(t, Version{Time: 1000, Counter: 0, Node: "a"}, c.Now())
+	assert.Equal(t, Version{Time: 1000, Counter: 1, Node: "a"}, c.Now())
+
+	// the physical clock moves forward
+	now = time.UnixMilli(2000)
+	assert.Equal(t, Version{Time: 2000, Counter: 0, Node: "a"}, c.Now())
+
+	// a version from the future was observed
+	c.Observe(Version{Time: 5000, Counter: 3, Node: "b"})
+	assert.Equal(t, Version{Time: 5000, Counter: 4, Node: "a"}, c.Now())
+
+	// the physical clock goes backward
+	now = time.UnixMilli(1500)
+	assert.Equal(t, Version{Time: 5000, Counter: 5, Node: "a"}, c.Now())
+}
+
+func TestHLCMaxOffset(t *testing.T) {
+	now := time.UnixMilli(1000)
+	c := newHLC("a", func() time.Time {
+		return now
+	}, time.Second)
+
+	// within the offset
+	assert.NoError(t, c.Observe(Version{Time: 2000, Counter: 3, Node: "b"}))
+	assert.Equal(t, Version{Time: 2000, Counter: 4, Node: "a"}, c.Now())
+
+	// beyond the offset, the clock does not follow
+	assert.Error(t, c.Observe(Version{Time: 2001, Counter: 0, Node: "b"}))
+	assert.Error(t, c.Observe(Version{Time: 1 << 50, Counter: 0, Node: "b"}))
+	assert.Equal(t, Version{Time: 2000, Counter: 5, Node: "a"}, c.Now())
+
+	// the versions of the node itself are kept
+	assert.NoError(t, c.Observe(Version{Time: 2500, Counter: 0, Node: "a"}))
+	assert.Equal(t, Version{Time: 2500, Counter: 1, Node: "a"}, c.Now())
+
+	// the physical clock moves forward
+	now = time.UnixMilli(3000)
+	assert.NoError(t, c.Observe(Version{Time: 4000, Counter: 0, Node: "b"}))
+	assert.Equal(t, Version{Time: 4000, Counter: 1, Node: "a"}, c.Now())
+}
+
+func TestHLCSurvivesRestart(t *testing.T) {
+	now := time.UnixMilli(1000)
+	physical := func() time.Time {
+		return now
+	}
+	before := newHLC("a", physical, time.Minute).Now()
+	now = now.Add(time.Millisecond)
+	after := newHLC("a", physical, time.Minute).Now()
+	assert.True(t, after.After(before))
+}
@@ -24,26 +24,164 @@
 
 package gossip
 
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
 // VersionedStr is a string that can be used to version a string.
 type VersionedStr struct {
 	// Version is the version of the string.
-	Version int `json:"version"`
+	Version Version `json:"version"`
 	// Value is the string.
 	Value string `json:"value"`
+	// Deleted is true if the string is a tombstone of a deleted key.
+	// The tombstone was written at the time of its version.
+	Deleted bool `json:"deleted,omitempty"`
+	// CRDT is the value when the key is a CRDT, instead of the string.
+	CRDT CRDT `json:"-"`
+	// Expires is the time the value expires at, in unix milliseconds,
+	// or 0 if it does not expire. It derives from the version, so that
+	// every node expires the value at the same time.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// versionedStrJSON is the JSON encoding of a VersionedStr,
+// with the type of the CRDT next to its encoding
+type versionedStrJSON struct {
+	Version Version         `json:"version"`
+	Value   string          `json:"value"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Type    CRDTType        `json:"type,omitempty"`
+	CRDT    json.RawMessage `json:"crdt,omitempty"`
+	Expires int64           `json:"expires,omitempty"`
+}
+
+// MarshalJSON encodes the VersionedStr with the type of its CRDT
+func (v VersionedStr) MarshalJSON() ([]byte, error) {
+	enc := versionedStrJSON{
+		Version: v.Version,
+		Value:   v.Value,
+		Deleted: v.Deleted,
+		Expires: v.Expires,
+	}
+	if v.CRDT != nil {
+		data, err := json.Marshal(v.CRDT)
+		if err != nil {
+			return nil, err
+		}
+		enc.Type = v.CRDT.Type()
+		enc.CRDT = data
+	}
+	return json.Marshal(enc)
+}
+
+// UnmarshalJSON decodes the VersionedStr and its CRDT
+func (v *VersionedStr) UnmarshalJSON(data []byte) error {
+	var enc versionedStrJSON
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	v.Version = enc.Version
+	v.Value = enc.Value
+	v.Deleted = enc.Deleted
+	v.Expires = enc.Expires
+	v.CRDT = nil
+	if enc.Type != "" {
+		crdt, err := decodeCRDT(enc.Type, enc.CRDT)
+		if err != nil {
+			return err
+		}
+		v.CRDT = crdt
+	}
+	return nil
 }
 
 // newVersionedStr returns a new VersionedStr.
-func newVersionedStr(value string) *VersionedStr {
+func newVersionedStr(value string, version Version) *VersionedStr {
 	return &VersionedStr{
-		Version: 0,
+		Version: version,
 		Value:   value,
 	}
 }
 
-// set the value of the VersionedStr and increments the version.
-func (v *VersionedStr) set(value string) {
-	if v.Value != value {
-		v.Version++
+// expiry returns the expiry of a value written at the given
+// version with the given ttl, or 0 if the ttl is not positive
+func expiry(version Version, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return version.Time + ttl.Milliseconds()
+}
+
+// changes returns true if setting the value with the given ttl changes
+// the VersionedStr. A value with a ttl always changes, since setting it
+// again postpones its expiry.
+func (v *VersionedStr) changes(value string, ttl time.Duration) bool {
+	return v.Value != value || v.Deleted || v.CRDT != nil || ttl > 0 || v.Expires != 0
+}
+
+// set the value of the VersionedStr at the given version, expiring after
+// the given ttl if it is positive. The version is only updated if the
+// value changes.
+func (v *VersionedStr) set(value string, version Version, ttl time.Duration) {
+	if v.changes(value, ttl) {
+		v.Version = version
 		v.Value = value
+		v.Deleted = false
+		v.CRDT = nil
+		v.Expires = expiry(version, ttl)
 	}
 }
+
+// expired returns true if the value expired at the given time
+func (v *VersionedStr) expired(now time.Time) bool {
+	return v.Expires != 0 && v.Expires <= now.UnixMilli()
+}
+
+// delete turns the VersionedStr into a tombstone at the given version.
+func (v *VersionedStr) delete(version Version) {
+	if !v.Deleted {
+		v.Version = version
+		v.Value = ""
+		v.Deleted = true
+		v.CRDT = nil
+		v.Expires = 0
+	}
+}
+
+// newer returns true if the VersionedStr supersedes the other one.
+// On a version tie, a tombstone wins, so that a deleted key
+// never comes back.
+func (v *VersionedStr) newer(other *VersionedStr) bool {
+	if v.Version != other.Version {
+		return v.Version.After(other.Version)
+	}
+	return v.Deleted && !other.Deleted
+}
+
+// equal returns true if the two VersionedStr are the same
+func (v *VersionedStr) equal(other *VersionedStr) bool {
+	return v.Version == other.Version &&
+		v.Value == other.Value &&
+		v.Deleted == other.Deleted &&
+		v.Expires == other.Expires &&
+		reflect.DeepEqual(v.CRDT, other.CRDT)
+}
+
+// join returns the join of two values of a same CRDT key, at the highest
+// of their versions. It returns false if they are not CRDTs of the same type.
+func (v *VersionedStr) join(other *VersionedStr) (*VersionedStr, bool) {
+	if v.Deleted || other.Deleted || v.CRDT == nil || other.CRDT == nil || v.CRDT.Type() != other.CRDT.Type() {
+		return nil, false
+	}
+	version := v.Version
+	if other.Version.After(version) {
+		version = other.Version
+	}
+	return &VersionedStr{
+		Version: version,
+		CRDT:    v.CRDT.Merge(other.CRDT),
+	}, true
+}
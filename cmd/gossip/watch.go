@@ -0,0 +1,162 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// subscriptionBuffer is the number of events buffered for a subscriber
+const subscriptionBuffer = 256
+
+// Event is a change of a key of the cluster metadata.
+type Event struct {
+	// Node is the id of the node that wrote the key.
+	Node string `json:"node"`
+	// Key is the changed key.
+	Key string `json:"key"`
+	// OldVersion is the version of the key before the change,
+	// or the zero Version if the key did not exist.
+	OldVersion Version `json:"old_version"`
+	// NewVersion is the version of the key after the change.
+	NewVersion Version `json:"new_version"`
+	// Value is the value of the key after the change.
+	Value *VersionedStr `json:"value"`
+}
+
+// newEvent returns the event of a change of a key
+func newEvent(node string, key string, oldVersion Version, v *VersionedStr) Event {
+	// the value is copied since the local values are modified in place
+	value := *v
+	return Event{
+		Node:       node,
+		Key:        key,
+		OldVersion: oldVersion,
+		NewVersion: v.Version,
+		Value:      &value,
+	}
+}
+
+// subscription is a subscription to the changes of the keys with a prefix
+type subscription struct {
+	prefix string
+	events chan Event
+}
+
+// Subscribe returns a channel that receives an event whenever a key
+// starting with the given prefix changes, and a function to cancel the
+// subscription. The channel is closed when the subscription is canceled,
+// or if the subscriber does not keep up with the events. The heartbeats
+// change every round, they are only sent if the prefix is the heartbeat key.
+func (s *Server) Subscribe(prefix string) (<-chan Event, func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sub := &subscription{
+		prefix: prefix,
+		events: make(chan Event, subscriptionBuffer),
+	}
+	s.subscriptions[sub] = struct{}{}
+	cancel := func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.unsubscribe(sub)
+	}
+	return sub.events, cancel
+}
+
+// unsubscribe removes the subscription and closes its channel.
+// It must be called with the lock held.
+func (s *Server) unsubscribe(sub *subscription) {
+	if _, ok := s.subscriptions[sub]; !ok {
+		return
+	}
+	delete(s.subscriptions, sub)
+	close(sub.events)
+}
+
+// publish sends the events to the subscribers, and marks the hashing
+// ring as stale if tags changed. It must be called with the lock held.
+func (s *Server) publish(events ...Event) {
+	for _, event := range events {
+		if strings.HasPrefix(event.Key, keyTagPrefix) {
+			s.ringStale = true
+		}
+	}
+	for sub := range s.subscriptions {
+		for _, event := range events {
+			if !strings.HasPrefix(event.Key, sub.prefix) || event.Key == keyHeartbeat && sub.prefix != keyHeartbeat {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			default:
+				// the subscriber is too slow, it would
+				// rather know than miss events silently
+				s.unsubscribe(sub)
+			}
+			if _, ok := s.subscriptions[sub]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// watch streams the changes of the keys as server-sent events
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := s.Subscribe(r.URL.Query().Get("prefix"))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			jsonBytes, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: change\ndata: %s\n\n", jsonBytes); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gossip
+
+import (
+	"context"
+	"dsa/cmd/gossip/client"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	now := time.UnixMilli(1000)
+	s := newTestServer("a", func() time.Time {
+		return now
+	})
+	events, cancel := s.Subscribe("app_")
+	defer cancel()
+
+	s.addLocalState("app_a", "a")
+	s.addLocalState("other", "b")
+	s.addLocalState("app_a", "b")
+	s.deleteLocalState("app_a")
+	s.receive(&Message{
+		From: "b",
+		Metadata: ClusterMetadata{
+			"b": NodeState{
+				"app_b": &VersionedStr{Version: Version{Time: 2000, Node: "b"}, Value: "b"},
+			},
+		},
+	}, now)
+
+	expect := []Event{
+		{
+			Node:       "a",
+			Key:        "app_a",
+			NewVersion: Version{Time: 1000, Node: "a"},
+			Value:      &VersionedStr{Version: Version{Time: 1000, Node: "a"}, Value: "a"},
+		}, {
+			Node:       "a",
+			Key:        "app_a",
+			OldVersion: Version{Time: 1000, Node: "a"},
+			NewVersion: Version{Time: 1000, Counter: 2, Node: "a"},
+			Value:      &VersionedStr{Version: Version{Time: 1000, Counter: 2, Node: "a"}, Value: "b"},
+		}, {
+			Node:       "a",
+			Key:        "app_a",
+			OldVersion: Version{Time: 1000, Counter: 2, Node: "a"},
+			NewVersion: Version{Time: 1000, Counter: 3, Node: "a"},
+			Value:      &VersionedStr{Version: Version{Time: 1000, Counter: 3, Node: "a"}, Deleted: true},
+		}, {
+			Node:       "b",
+			Key:        "app_b",
+			NewVersion: Version{Time: 2000, Node: "b"},
+			Value:      &VersionedStr{Version: Version{Time: 2000, Node: "b"}, Value: "b"},
+		},
+	}
+	for _, e := range expect {
+		assert.Equal(t, e, <-events)
+	}
+	assert.Empty(t, events)
+
+	// merging the same state again does not change anything
+	s.receive(&Message{
+		From: "b",
+		Metadata: ClusterMetadata{
+			"b": NodeState{
+				"app_b": &VersionedStr{Version: Version{Time: 2000, Node: "b"}, Value: "b"},
+			},
+		},
+	}, now)
+	assert.Empty(t, events)
+}
+
+func TestSubscribeHeartbeats(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	events, cancel := s.Subscribe("")
+	defer cancel()
+	heartbeats, cancelHeartbeats := s.Subscribe(keyHeartbeat)
+	defer cancelHeartbeats()
+
+	s.addLocalState(keyHeartbeat, "1")
+	s.addLocalState("a", "a")
+	assert.Equal(t, "a", (<-events).Key)
+	assert.Empty(t, events)
+	assert.Equal(t, keyHeartbeat, (<-heartbeats).Key)
+	assert.Empty(t, heartbeats)
+}
+
+func TestSubscribeSlowSubscriber(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	events, cancel := s.Subscribe("")
+	defer cancel()
+	for i := 0; i <= subscriptionBuffer; i++ {
+		s.addLocalState("a", string(rune('a'+i%2)))
+	}
+	count := 0
+	for range events {
+		count++
+	}
+	assert.Equal(t, subscriptionBuffer, count)
+	assert.Empty(t, s.subscriptions)
+}
+
+func TestWatch(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := client.New(strings.TrimPrefix(srv.URL, "http://"), client.Config{})
+	events, errs, err := c.Watch(ctx, "app_")
+	assert.NoError(t, err)
+
+	s.lock.Lock()
+	s.addLocalState("other", "a")
+	s.addLocalState("app_a", "a")
+	s.lock.Unlock()
+
+	event := <-events
+	assert.Equal(t, "a", event.Node)
+	assert.Equal(t, "app_a", event.Key)
+	assert.Equal(t, "a", event.Value.Value)
+
+	cancel()
+	for range events {
+	}
+	assert.NoError(t, <-errs)
+}
+
+func TestWatchLargeEvents(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// escaped in JSON, the value is larger than the default buffer of a scanner
+	value := strings.Repeat("<", 40<<10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := client.New(strings.TrimPrefix(srv.URL, "http://"), client.Config{})
+	events, errs, err := c.Watch(ctx, "app_")
+	assert.NoError(t, err)
+
+	s.lock.Lock()
+	s.addLocalState("app_a", value)
+	s.lock.Unlock()
+
+	event := <-events
+	assert.Equal(t, value, event.Value.Value)
+
+	cancel()
+	for range events {
+	}
+	assert.NoError(t, <-errs)
+
+	c = client.New(strings.TrimPrefix(srv.URL, "http://"), client.Config{MaxEventSize: 1 << 10})
+	events, errs, err = c.Watch(context.Background(), "app_")
+	assert.NoError(t, err)
+
+	s.lock.Lock()
+	s.addLocalState("app_a", value+"<")
+	s.lock.Unlock()
+
+	for range events {
+	}
+	assert.Error(t, <-errs)
+}
+
+func TestWatchWithoutContentType(t *testing.T) {
+	s := newTestServer("a", time.Now)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// such as EventSource in browsers
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/watch", nil)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// the writes still need one
+	resp, err = http.Post(srv.URL, "text/plain", strings.NewReader(`{"a":"a"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,262 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cmd
+
+import (
+	"dsa/cmd/gossip"
+	"dsa/cmd/gossip/client"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var clientAddr string
+var clientOutput string
+var clientTLSCert string
+var clientTLSKey string
+var clientTLSCA string
+var clientTTL time.Duration
+var clientSelector string
+
+// gossipSetCmd represents the gossip set command
+var gossipSetCmd = &cobra.Command{
+	Use:   "set key=value...",
+	Short: "Write keys on a gossip node",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		values := make(map[string]string)
+		for _, arg := range args {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("invalid key value pair %q, expected key=value", arg)
+			}
+			values[key] = value
+		}
+		c, err := newGossipClient()
+		if err != nil {
+			return err
+		}
+		if clientTTL > 0 {
+			return c.SetTTL(cmd.Context(), values, clientTTL)
+		}
+		return c.Set(cmd.Context(), values)
+	},
+}
+
+// gossipGetCmd represents the gossip get command
+var gossipGetCmd = &cobra.Command{
+	Use:   "get [node] [key]",
+	Short: "Read the keys known by a gossip node",
+	Long: `Prints the keys of every node known by the gossip node, the keys
+of the given node only, or the value of the given key of the given node.`,
+	Args: cobra.MaximumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGossipClient()
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		if len(args) == 2 {
+			value, err := c.Get(cmd.Context(), args[0], args[1])
+			if err != nil {
+				return err
+			}
+			if clientOutput == "json" {
+				return writeJSON(out, value)
+			}
+			_, err = fmt.Fprintln(out, formatValue(value))
+			return err
+		}
+		state, err := c.State(cmd.Context())
+		if err != nil {
+			return err
+		}
+		metadata := make(map[string]map[string]client.Value)
+		for node, values := range state.Metadata {
+			if len(args) == 1 && node != args[0] {
+				continue
+			}
+			metadata[node] = make(map[string]client.Value)
+			for key, value := range values {
+				if !value.Deleted {
+					metadata[node][key] = value
+				}
+			}
+		}
+		if clientOutput == "json" {
+			return writeJSON(out, metadata)
+		}
+		return writeValues(out, metadata)
+	},
+}
+
+// gossipMembersCmd represents the gossip members command
+var gossipMembersCmd = &cobra.Command{
+	Use:   "members",
+	Short: "List the live members of the cluster known by a gossip node",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGossipClient()
+		if err != nil {
+			return err
+		}
+		members, err := c.Members(cmd.Context(), clientSelector)
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		if clientOutput == "json" {
+			return writeJSON(out, members)
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tADDRESS\tSTATUS\tINCARNATION\tTAGS")
+		for _, member := range members {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", member.ID, member.Address, member.Status, member.Incarnation, formatTags(member.Tags))
+		}
+		return tw.Flush()
+	},
+}
+
+// gossipLeaderCmd represents the gossip leader command
+var gossipLeaderCmd = &cobra.Command{
+	Use:   "leader",
+	Short: "Show the leader of the cluster seen by a gossip node",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGossipClient()
+		if err != nil {
+			return err
+		}
+		leadership, err := c.Leader(cmd.Context())
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		if clientOutput == "json" {
+			return writeJSON(out, leadership)
+		}
+		leader, conflicts := leadership.Leader, strings.Join(leadership.Conflicts, ",")
+		if leader == "" {
+			leader = "-"
+		}
+		if conflicts == "" {
+			conflicts = "-"
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "LEADER\tINCARNATION\tQUORUM\tCONFLICTS")
+		fmt.Fprintf(tw, "%s\t%d\t%t\t%s\n", leader, leadership.Incarnation, leadership.Quorum, conflicts)
+		return tw.Flush()
+	},
+}
+
+// newGossipClient returns a client of the node given by the flags
+func newGossipClient() (*client.Client, error) {
+	if clientOutput != "table" && clientOutput != "json" {
+		return nil, fmt.Errorf("invalid output %q", clientOutput)
+	}
+	config := client.Config{}
+	if clientTLSCert != "" {
+		tlsConfig, err := gossip.LoadMutualTLS(clientTLSCert, clientTLSKey, clientTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.TLSConfig = tlsConfig
+	}
+	return client.New(clientAddr, config), nil
+}
+
+// writeValues writes a table of the values of each node, sorted by node and key
+func writeValues(w io.Writer, metadata map[string]map[string]client.Value) error {
+	var nodes []string
+	for node := range metadata {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tKEY\tVALUE\tUPDATED\tEXPIRES")
+	for _, node := range nodes {
+		var keys []string
+		for key := range metadata[node] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := metadata[node][key]
+			updated := time.UnixMilli(value.Version.Time).UTC().Format(time.RFC3339)
+			expires := "-"
+			if value.Expires != 0 {
+				expires = time.UnixMilli(value.Expires).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", node, key, formatValue(value), updated, expires)
+		}
+	}
+	return tw.Flush()
+}
+
+// formatValue returns the printed form of a value, the JSON encoding of CRDTs
+func formatValue(value client.Value) string {
+	if value.Type != "" {
+		return value.Type + " " + string(value.CRDT)
+	}
+	return value.Value
+}
+
+// formatTags returns the sorted key=value pairs of the tags
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return "-"
+	}
+	var pairs []string
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// writeJSON writes the indented JSON encoding of v
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func init() {
+	gossipSetCmd.Flags().DurationVar(&clientTTL, "ttl", 0, "time after which the keys expire, unless they are set again")
+	gossipMembersCmd.Flags().StringVar(&clientSelector, "selector", "", "tags of the listed members, such as role=db,zone!=a")
+	for _, cmd := range []*cobra.Command{gossipSetCmd, gossipGetCmd, gossipMembersCmd, gossipLeaderCmd} {
+		gossipCmd.AddCommand(cmd)
+		cmd.Flags().StringVar(&clientAddr, "addr", "localhost:8080", "address of the gossip node")
+		cmd.Flags().StringVarP(&clientOutput, "output", "o", "table", "output format (table or json)")
+		cmd.Flags().StringVar(&clientTLSCert, "tls-cert", "", "client certificate, for nodes using mutual tls")
+		cmd.Flags().StringVar(&clientTLSKey, "tls-key", "", "private key of the client certificate")
+		cmd.Flags().StringVar(&clientTLSCA, "tls-ca", "", "certificate authority of the cluster")
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 Ludovic Cleroux
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cmd
+
+import (
+	"context"
+	"dsa/cmd/gossip"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"time"
+)
+
+var clusterNodes int
+var clusterHost string
+var clusterBasePort int
+var clusterRefresh time.Duration
+var clusterConfig = gossip.DefaultConfig()
+
+// gossipClusterCmd represents the gossip cluster command
+var gossipClusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Run a local gossip cluster",
+	Long: `Starts several gossip servers in the same process, on consecutive ports,
+seeded with each other, and prints their members until interrupted.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if clusterNodes <= 0 {
+			clusterNodes = 3
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		cluster := gossip.NewCluster(clusterNodes, clusterHost, clusterBasePort, clusterConfig)
+		go func() {
+			if err := cluster.Watch(ctx, cmd.OutOrStdout(), clusterRefresh); err != nil {
+				cancel()
+			}
+		}()
+		return cluster.Start(ctx)
+	},
+}
+
+func init() {
+	gossipCmd.AddCommand(gossipClusterCmd)
+	gossipClusterCmd.Flags().IntVar(&clusterNodes, "nodes", 3, "number of nodes")
+	gossipClusterCmd.Flags().StringVar(&clusterHost, "host", "localhost", "host the nodes listen on")
+	gossipClusterCmd.Flags().IntVar(&clusterBasePort, "base-port", 8080, "port of the first node, the others use the next ports, random ports if 0")
+	gossipClusterCmd.Flags().DurationVar(&clusterRefresh, "refresh", time.Second, "time between two refreshes of the table")
+	gossipClusterCmd.Flags().DurationVar(&clusterConfig.Interval, "interval", clusterConfig.Interval, "time between two gossip rounds")
+	gossipClusterCmd.Flags().IntVar(&clusterConfig.Fanout, "fanout", clusterConfig.Fanout, "number of nodes to gossip with every round")
+}